@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes Message envelopes for the wire. Every payload except JSON
+// is prefixed with the codec's tag byte, so a consumer can decode messages
+// from publishers using any codec while a rollout switches between them.
+// JSON stays untagged so that it remains readable by older consumers.
+type Codec interface {
+	Name() string
+	Tag() byte
+	Marshal(m Message) ([]byte, error)
+	Unmarshal(data []byte, m *Message) error
+}
+
+const (
+	tagJSON     byte = 0
+	tagMsgpack  byte = 1
+	tagProtobuf byte = 2
+)
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var codecsByTag = map[byte]Codec{
+	tagMsgpack:  MsgpackCodec,
+	tagProtobuf: ProtobufCodec,
+}
+
+// CodecByName returns the codec selected in configuration.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown broker codec %q", name)
+}
+
+// Encode marshals m with c and adds the codec tag.
+func Encode(c Codec, m Message) ([]byte, error) {
+	body, err := c.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if c.Tag() == tagJSON {
+		return body, nil
+	}
+	return append([]byte{c.Tag()}, body...), nil
+}
+
+// Decode unmarshals a payload produced by Encode with any known codec.
+func Decode(payload []byte, m *Message) error {
+	if len(payload) == 0 {
+		return errors.New("empty payload")
+	}
+	if isJSON(payload[0]) {
+		return JSONCodec.Unmarshal(payload, m)
+	}
+	c, ok := codecsByTag[payload[0]]
+	if !ok {
+		return fmt.Errorf("unknown codec tag %#x", payload[0])
+	}
+	return c.Unmarshal(payload[1:], m)
+}
+
+func isJSON(b byte) bool {
+	switch b {
+	case '{', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Tag() byte    { return tagJSON }
+
+func (jsonCodec) Marshal(m Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m *Message) error {
+	return json.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Tag() byte    { return tagMsgpack }
+
+func (msgpackCodec) Marshal(m Message) ([]byte, error) {
+	return msgpack.Marshal(&m)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, m *Message) error {
+	return msgpack.Unmarshal(data, m)
+}
+
+// RawData returns the text payload of the message without type assertions.
+// String data, which is how the pooler publishes text frames, is returned
+// verbatim; any other value is JSON-encoded.
+func (m Message) RawData() ([]byte, error) {
+	switch data := m.Data.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(data), nil
+	case []byte:
+		return data, nil
+	default:
+		return json.Marshal(data)
+	}
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufCodec encodes Message with the protobuf wire format described in
+// message.proto. Data has no protobuf type of its own, so it is carried as
+// JSON bytes in the data_json field.
+type protobufCodec struct{}
+
+const (
+	pbFieldType      protowire.Number = 1
+	pbFieldClientID  protowire.Number = 2
+	pbFieldDataJSON  protowire.Number = 3
+	pbFieldRequestID protowire.Number = 4
+	pbFieldConnID    protowire.Number = 5
+	pbFieldPoolerID  protowire.Number = 6
+	pbFieldTrace     protowire.Number = 7
+	pbFieldOpcode    protowire.Number = 8
+	pbFieldBinary    protowire.Number = 9
+	pbFieldClaims    protowire.Number = 10
+	pbFieldBroadcast protowire.Number = 11
+
+	pbMapKey   protowire.Number = 1
+	pbMapValue protowire.Number = 2
+)
+
+func (protobufCodec) Name() string { return "protobuf" }
+func (protobufCodec) Tag() byte    { return tagProtobuf }
+
+func (protobufCodec) Marshal(m Message) ([]byte, error) {
+	var b []byte
+	b = appendString(b, pbFieldType, m.Type)
+	b = appendString(b, pbFieldClientID, m.ClientID)
+	if m.Data != nil {
+		data, err := json.Marshal(m.Data)
+		if err != nil {
+			return nil, fmt.Errorf("encode data: %w", err)
+		}
+		b = protowire.AppendTag(b, pbFieldDataJSON, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	b = appendString(b, pbFieldRequestID, m.RequestID)
+	b = appendString(b, pbFieldConnID, m.ConnID)
+	b = appendString(b, pbFieldPoolerID, m.PoolerID)
+	for k, v := range m.Trace {
+		var entry []byte
+		entry = appendString(entry, pbMapKey, k)
+		entry = appendString(entry, pbMapValue, v)
+		b = protowire.AppendTag(b, pbFieldTrace, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if m.Opcode != 0 {
+		b = protowire.AppendTag(b, pbFieldOpcode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Opcode))
+	}
+	if len(m.Binary) > 0 {
+		b = protowire.AppendTag(b, pbFieldBinary, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Binary)
+	}
+	if len(m.Claims) > 0 {
+		claims, err := json.Marshal(m.Claims)
+		if err != nil {
+			return nil, fmt.Errorf("encode claims: %w", err)
+		}
+		b = protowire.AppendTag(b, pbFieldClaims, protowire.BytesType)
+		b = protowire.AppendBytes(b, claims)
+	}
+	if m.Broadcast {
+		b = protowire.AppendTag(b, pbFieldBroadcast, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b, nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func (protobufCodec) Unmarshal(data []byte, m *Message) error {
+	*m = Message{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ == protowire.VarintType && (num == pbFieldOpcode || num == pbFieldBroadcast) {
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if num == pbFieldOpcode {
+				m.Opcode = int(v)
+			} else {
+				m.Broadcast = v != 0
+			}
+			data = data[n:]
+			continue
+		}
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case pbFieldType:
+			m.Type = string(v)
+		case pbFieldClientID:
+			m.ClientID = string(v)
+		case pbFieldDataJSON:
+			if err := json.Unmarshal(v, &m.Data); err != nil {
+				return fmt.Errorf("decode data: %w", err)
+			}
+		case pbFieldRequestID:
+			m.RequestID = string(v)
+		case pbFieldConnID:
+			m.ConnID = string(v)
+		case pbFieldPoolerID:
+			m.PoolerID = string(v)
+		case pbFieldTrace:
+			k, val, err := consumeMapEntry(v)
+			if err != nil {
+				return err
+			}
+			if m.Trace == nil {
+				m.Trace = make(map[string]string)
+			}
+			m.Trace[k] = val
+		case pbFieldBinary:
+			m.Binary = append([]byte(nil), v...)
+		case pbFieldClaims:
+			if err := json.Unmarshal(v, &m.Claims); err != nil {
+				return fmt.Errorf("decode claims: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func consumeMapEntry(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case pbMapKey:
+			key = string(v)
+		case pbMapValue:
+			value = string(v)
+		}
+	}
+	return key, value, nil
+}
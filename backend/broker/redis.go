@@ -4,11 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wailbentafat/ws-hub/backend/tracing"
 )
 
 const (
@@ -16,15 +21,34 @@ const (
 	initialBackoff = 100 * time.Millisecond
 	maxBackoff     = 5 * time.Second
 )
-func NewRedisBrokerFromClient(client *redis.Client) (*RedisBroker, error) {
-    return &RedisBroker{client: client}, nil
-}
 
 type RedisBroker struct {
 	client *redis.Client
+	codec  Codec
+}
+
+// Option configures a RedisBroker.
+type Option func(*RedisBroker)
+
+// WithCodec selects the codec used for published messages. Subscriptions
+// decode every known codec regardless of this setting.
+func WithCodec(c Codec) Option {
+	return func(b *RedisBroker) { b.codec = c }
+}
+
+func newRedisBroker(client *redis.Client, opts []Option) *RedisBroker {
+	b := &RedisBroker{client: client, codec: JSONCodec}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func NewRedisBrokerFromClient(client *redis.Client, opts ...Option) (*RedisBroker, error) {
+	return newRedisBroker(client, opts), nil
 }
 
-func NewRedisBroker(addr string) (*RedisBroker, error) {
+func NewRedisBroker(addr string, opts ...Option) (*RedisBroker, error) {
 	client := redis.NewClient(&redis.Options{Addr: addr})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -34,7 +58,7 @@ func NewRedisBroker(addr string) (*RedisBroker, error) {
 		return nil, fmt.Errorf("redis connection failed: %w", err)
 	}
 
-	return &RedisBroker{client: client}, nil
+	return newRedisBroker(client, opts), nil
 }
 
 func (m Message) MarshalBinary() ([]byte, error) {
@@ -45,9 +69,32 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data, m)
 }
 
-func (b *RedisBroker) Publish(ctx context.Context, channel string, message Message) error {
+func (b *RedisBroker) Publish(ctx context.Context, channel string, message Message) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "broker.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", channel),
+			attribute.String("wshub.codec", b.codec.Name()),
+			attribute.String("wshub.client_id", message.ClientID),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	message.Trace = tracing.Inject(ctx)
+
+	payload, err := Encode(b.codec, message)
+	if err != nil {
+		return fmt.Errorf("encode message for %s: %w", channel, err)
+	}
+
 	operation := func() error {
-		return b.client.Publish(ctx, channel, message).Err()
+		return b.client.Publish(ctx, channel, payload).Err()
 	}
 
 	backoffStrategy := backoff.WithContext(
@@ -62,7 +109,7 @@ func (b *RedisBroker) Publish(ctx context.Context, channel string, message Messa
 	)
 
 	return backoff.RetryNotify(operation, backoffStrategy, func(err error, d time.Duration) {
-		log.Printf("Retrying Redis publish for %s: %v (next attempt in %s)", message.ClientID, err, d)
+		slog.Warn("Retrying Redis publish", "channel", channel, "client_id", message.ClientID, "request_id", message.RequestID, "error", err, "retry_in", d)
 	})
 }
 
@@ -92,8 +139,8 @@ func (b *RedisBroker) Subscribe(ctx context.Context, channel string) (<-chan Mes
 				}
 
 				var message Message
-				if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
-					log.Printf("Message decode error: %v", err)
+				if err := Decode([]byte(msg.Payload), &message); err != nil {
+					slog.Error("Message decode error", "channel", channel, "error", err)
 					continue
 				}
 
@@ -105,6 +152,11 @@ func (b *RedisBroker) Subscribe(ctx context.Context, channel string) (<-chan Mes
 	return messages, nil
 }
 
+func (b *RedisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Close cleans up resources
 func (b *RedisBroker) Close() error {
 	return b.client.Close()
 }
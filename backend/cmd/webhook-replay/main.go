@@ -0,0 +1,68 @@
+// Command webhook-replay redelivers the webhook deliveries recorded in the
+// backend's dead-letter log. Delivered entries are removed from the log;
+// entries that fail again stay in it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "webhook-replay:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("webhook-replay", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("WEBHOOKS_CONFIG"), "webhook endpoints file, as used by the backend")
+	deadLetter := fs.String("dead-letter", envOr("WEBHOOK_DEAD_LETTER", "webhooks-dead-letter.jsonl"), "dead-letter log to replay")
+	list := fs.Bool("list", false, "print the entries without replaying them")
+	maxElapsed := fs.Duration("retry-max-elapsed", 30*time.Second, "how long to keep retrying each delivery")
+	fs.Parse(args)
+
+	if *list {
+		entries, err := webhook.ReadDeadLetters(*deadLetter)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf("%s  %-24s %s  %s  attempts=%d  %s\n",
+				e.FailedAt.Format(time.RFC3339), e.Event.Type, e.Event.ID, e.URL, e.Attempts, e.Error)
+		}
+		fmt.Printf("%d entries\n", len(entries))
+		return nil
+	}
+
+	if *configPath == "" {
+		return fmt.Errorf("-config or WEBHOOKS_CONFIG is required to sign deliveries")
+	}
+	endpoints, err := webhook.LoadEndpoints(*configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	result, err := webhook.Replay(ctx, *deadLetter, webhook.Config{
+		Endpoints:       endpoints,
+		RetryMaxElapsed: *maxElapsed,
+	})
+	fmt.Printf("delivered=%d failed=%d skipped=%d\n", result.Delivered, result.Failed, result.Skipped)
+	return err
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/backend/broker"
+	"github.com/wailbentafat/ws-hub/backend/logging"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/service"
+	"github.com/wailbentafat/ws-hub/backend/tracing"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+)
+
+// Config holds the backend settings read from the environment.
+type Config struct {
+	RedisAddr  string
+	HealthAddr string
+	// RequestChannels are the request channels this backend answers. With
+	// routing on the poolers, each names the channel of a service.
+	RequestChannels []string
+	// RequestConcurrency bounds the requests handled at once per request
+	// channel; above 1 they may be answered out of order. Events are always
+	// handled in order. HandlerTimeout bounds each handler.
+	RequestConcurrency int
+	HandlerTimeout     time.Duration
+	// PushAddr serves the push API, which is off unless Push.Token is set.
+	PushAddr string
+	Push     service.PushConfig
+	// PushQueueLimit and PushQueueTTL bound the pushes queued per offline
+	// user.
+	PushQueueLimit int
+	PushQueueTTL   time.Duration
+	// WebhooksConfig is the file listing webhook endpoints. Webhooks are
+	// off when it is empty.
+	WebhooksConfig string
+	Webhooks       webhook.Config
+	// RoomHistoryLimit is roughly how many messages each room keeps.
+	RoomHistoryLimit int
+	// BrokerCodec encodes published messages. Subscriptions accept all codecs.
+	BrokerCodec broker.Codec
+	Tracing     tracing.Config
+	Logging     logging.Config
+}
+
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		RedisAddr:       envString("REDIS_ADDR", "redis:6379"),
+		HealthAddr:      envString("HEALTH_ADDR", ":8081"),
+		PushAddr:        envString("PUSH_ADDR", ":8082"),
+		WebhooksConfig:  envString("WEBHOOKS_CONFIG", ""),
+		RequestChannels: envList("REQUEST_CHANNELS", service.BackendRequestsChannel),
+		Webhooks: webhook.Config{
+			DeadLetterPath: envString("WEBHOOK_DEAD_LETTER", "webhooks-dead-letter.jsonl"),
+		},
+		Push: service.PushConfig{
+			Token: envString("PUSH_TOKEN", ""),
+		},
+		Tracing: tracing.Config{
+			ServiceName: envString("OTEL_SERVICE_NAME", "ws-backend"),
+			Exporter:    envString("TRACING_EXPORTER", tracing.ExporterNone),
+			FilePath:    envString("TRACING_FILE", "traces.jsonl"),
+		},
+		Logging: logging.Config{
+			Level:    envString("LOG_LEVEL", "info"),
+			Format:   envString("LOG_FORMAT", logging.FormatText),
+			Payloads: envString("LOG_PAYLOADS", logging.PayloadRedact),
+		},
+	}
+
+	var err error
+	if cfg.RoomHistoryLimit, err = envInt("ROOM_HISTORY_LIMIT", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.RequestConcurrency, err = envInt("REQUEST_CONCURRENCY", 1); err != nil {
+		return nil, err
+	}
+	if cfg.HandlerTimeout, err = envDuration("HANDLER_TIMEOUT", sdk.DefaultHandlerTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.Push.MaxDataBytes, err = envInt("PUSH_MAX_DATA_BYTES", service.DefaultPushMaxDataBytes); err != nil {
+		return nil, err
+	}
+	if cfg.PushQueueLimit, err = envInt("PUSH_QUEUE_LIMIT", service.DefaultPushQueueLimit); err != nil {
+		return nil, err
+	}
+	if cfg.PushQueueTTL, err = envDuration("PUSH_QUEUE_TTL", service.DefaultPushQueueTTL); err != nil {
+		return nil, err
+	}
+	if cfg.Webhooks.Workers, err = envInt("WEBHOOK_WORKERS", 4); err != nil {
+		return nil, err
+	}
+	if cfg.Webhooks.QueueSize, err = envInt("WEBHOOK_QUEUE_SIZE", 1024); err != nil {
+		return nil, err
+	}
+	if cfg.Webhooks.Timeout, err = envDuration("WEBHOOK_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Webhooks.RetryInitial, err = envDuration("WEBHOOK_RETRY_INITIAL", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.Webhooks.RetryMaxElapsed, err = envDuration("WEBHOOK_RETRY_MAX_ELAPSED", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.WebhooksConfig != "" {
+		if cfg.Webhooks.Endpoints, err = webhook.LoadEndpoints(cfg.WebhooksConfig); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BrokerCodec, err = broker.CodecByName(envString("BROKER_CODEC", "json")); err != nil {
+		return nil, err
+	}
+	if cfg.Tracing.SampleRatio, err = envFloat("TRACING_SAMPLE_RATIO", 1); err != nil {
+		return nil, err
+	}
+	if cfg.Logging.PayloadSampleRate, err = envFloat("LOG_PAYLOAD_SAMPLE_RATE", 0.01); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key, fallback string) []string {
+	var list []string
+	for _, v := range strings.Split(envString(key, fallback), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
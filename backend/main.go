@@ -3,47 +3,139 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/wailbentafat/ws-hub/backend/broker"
-)
-
-const (
-    BackendRequestsChannel  = "backend-requests"
-    BackendResponsesChannel = "backend-responses"
+	"github.com/wailbentafat/ws-hub/backend/logging"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/service"
+	"github.com/wailbentafat/ws-hub/backend/tracing"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
 )
 
 func main() {
-    log.Println("Starting Backend Service...")
     ctx, cancel := context.WithCancel(context.Background())
     defer cancel()
 
+    cfg, err := LoadConfig()
+    if err != nil {
+        logging.Fatal("Invalid configuration", "error", err)
+    }
+
+    if err := logging.Setup(cfg.Logging, "service", cfg.Tracing.ServiceName); err != nil {
+        logging.Fatal("Invalid logging configuration", "error", err)
+    }
+    slog.Info("Starting Backend Service")
+
+    shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+    if err != nil {
+        logging.Fatal("Failed to set up tracing", "error", err)
+    }
+    defer func() {
+        flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer flushCancel()
+        if err := shutdownTracing(flushCtx); err != nil {
+            slog.Error("Tracing shutdown error", "error", err)
+        }
+    }()
+
     // --- Initialize Components ---
-    rdb := redis.NewClient(&redis.Options{Addr: "redis:6379"})
+    rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
     if err := rdb.Ping(ctx).Err(); err != nil {
-        log.Fatalf("Failed to connect to Redis: %v", err)
+        logging.Fatal("Failed to connect to Redis", "error", err)
     }
-    log.Println("Connected to Redis.")
+    slog.Info("Connected to Redis", "addr", cfg.RedisAddr)
     
-    messageBroker, err := broker.NewRedisBrokerFromClient(rdb)
+    messageBroker, err := broker.NewRedisBrokerFromClient(rdb, broker.WithCodec(cfg.BrokerCodec))
     if err != nil {
-        log.Fatalf("Failed to create broker: %v", err)
+        logging.Fatal("Failed to create broker", "error", err)
     }
     defer messageBroker.Close()
 
-    store := NewStore(rdb)
+    store := service.NewStore(rdb,
+        service.WithRoomHistoryLimit(cfg.RoomHistoryLimit),
+        service.WithPushQueue(cfg.PushQueueLimit, cfg.PushQueueTTL),
+    )
+
+    health := service.NewHealth(messageBroker)
 
-    log.Println("Starting listeners...")
-    go ListenForPresenceEvents(ctx, messageBroker, store)
-    go ListenForRequests(ctx, messageBroker, store)
+    var hooks *webhook.Dispatcher
+    hooksCtx, stopHooks := context.WithCancel(context.Background())
+    defer stopHooks()
+    if len(cfg.Webhooks.Endpoints) > 0 {
+        hooks = webhook.NewDispatcher(cfg.Webhooks)
+        hooks.Start(hooksCtx)
+        slog.Info("Webhooks enabled", "endpoints", len(cfg.Webhooks.Endpoints))
+    }
+
+    svc := sdk.New(messageBroker, sdk.Options{
+        Channels:       cfg.RequestChannels,
+        MaxConcurrency: cfg.RequestConcurrency,
+        HandlerTimeout: cfg.HandlerTimeout,
+    })
+    service.Register(svc, store, hooks)
+
+    slog.Info("Starting listeners")
+    serviceDone := make(chan struct{})
+    health.Go("service", func() {
+        defer close(serviceDone)
+        if err := svc.Run(ctx); err != nil {
+            slog.Error("Service stopped", "error", err)
+        }
+    })
+
+    healthServer := &http.Server{Addr: cfg.HealthAddr, Handler: health.Handler()}
+    go func() {
+        if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            logging.Fatal("Health server failed", "error", err)
+        }
+    }()
+    slog.Info("Health endpoints listening", "addr", cfg.HealthAddr)
+
+    var pushServer *http.Server
+    if cfg.Push.Token != "" {
+        pushServer = &http.Server{Addr: cfg.PushAddr, Handler: service.NewPushAPI(svc, store, cfg.Push)}
+        go func() {
+            if err := pushServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                logging.Fatal("Push server failed", "error", err)
+            }
+        }()
+        slog.Info("Push API listening", "addr", cfg.PushAddr)
+    }
     
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
     <-sigChan
 
-    log.Println("Shutdown signal received. Cleaning up.")
+    slog.Info("Shutdown signal received, cleaning up")
+    health.SetDraining()
+
+    shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer shutdownCancel()
+    if pushServer != nil {
+        if err := pushServer.Shutdown(shutdownCtx); err != nil {
+            slog.Error("Push server shutdown error", "error", err)
+        }
+    }
+    // Stop taking requests and let the handlers in flight finish.
+    cancel()
+    select {
+    case <-serviceDone:
+    case <-shutdownCtx.Done():
+        slog.Warn("Handlers still running at shutdown")
+    }
+    if err := healthServer.Shutdown(shutdownCtx); err != nil {
+        slog.Error("Health server shutdown error", "error", err)
+    }
+    if hooks != nil {
+        // Deliveries still queued are dead-lettered for replay.
+        stopHooks()
+        hooks.Wait()
+    }
 }
\ No newline at end of file
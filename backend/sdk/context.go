@@ -0,0 +1,143 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/wailbentafat/ws-hub/backend/broker"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying requestID, which SendToUser
+// and Broadcast tag their messages with.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID ctx carries, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// Context is the context of one message. It is a context.Context that is
+// done when the handler times out, carries the request ID and the trace of
+// the message, and knows how to answer its sender.
+type Context struct {
+	context.Context
+	service     *Service
+	channel     string
+	msg         broker.Message
+	requestType string
+	raw         []byte
+	// structured is false for a text request that is not a JSON object.
+	structured bool
+	// event is set for messages of an event channel, which get no replies.
+	event bool
+	log   *slog.Logger
+}
+
+// ClientID is the authenticated user who sent the request.
+func (c *Context) ClientID() string { return c.msg.ClientID }
+
+// ConnID is the connection the request came from.
+func (c *Context) ConnID() string { return c.msg.ConnID }
+
+// PoolerID is the pooler that holds the connection.
+func (c *Context) PoolerID() string { return c.msg.PoolerID }
+
+// RequestID is the pooler's ID for the request, echoed on every reply.
+func (c *Context) RequestID() string { return c.msg.RequestID }
+
+// Claims are the claims of the token the client connected with. They are
+// nil for messages that did not come from a client.
+func (c *Context) Claims() map[string]any { return c.msg.Claims }
+
+// Type is the request type the message was dispatched by, or the type of
+// an event.
+func (c *Context) Type() string { return c.requestType }
+
+// Channel is the channel the message arrived on.
+func (c *Context) Channel() string { return c.channel }
+
+// Data is the JSON data of the request; empty for binary requests.
+func (c *Context) Data() []byte { return c.raw }
+
+// Binary is the payload of a binary request; nil for text requests.
+func (c *Context) Binary() []byte {
+	if c.msg.Opcode != broker.OpcodeBinary {
+		return nil
+	}
+	return c.msg.Binary
+}
+
+// Message is the message as received from the broker.
+func (c *Context) Message() broker.Message { return c.msg }
+
+// Logger is annotated with the message's correlation IDs.
+func (c *Context) Logger() *slog.Logger { return c.log }
+
+// Service is the service handling the message.
+func (c *Context) Service() *Service { return c.service }
+
+// Bind decodes the request data into v. Data that does not decode is
+// reported as an invalid_request Error.
+func (c *Context) Bind(v any) error {
+	if err := json.Unmarshal(c.raw, v); err != nil {
+		return Errorf(ErrorCodeInvalidRequest, "Malformed %s request", c.requestType)
+	}
+	return nil
+}
+
+// Reply sends data to the connection the request came from.
+func (c *Context) Reply(data any) error {
+	return c.reply(c, broker.Message{Data: data})
+}
+
+// ReplyBinary sends payload to the connection the request came from as a
+// binary frame.
+func (c *Context) ReplyBinary(payload []byte) error {
+	return c.reply(c, broker.Message{Opcode: broker.OpcodeBinary, Binary: payload})
+}
+
+// ReplyError sends an error frame to the connection the request came from.
+// Handlers usually return an *Error instead.
+func (c *Context) ReplyError(code, message string) error {
+	return c.replyError(c, code, message)
+}
+
+func (c *Context) replyError(ctx context.Context, code, message string) error {
+	return c.reply(ctx, broker.Message{Data: ErrorFrame{
+		Type:      "error",
+		Code:      code,
+		Message:   message,
+		RequestID: c.msg.RequestID,
+	}})
+}
+
+func (c *Context) reply(ctx context.Context, msg broker.Message) error {
+	msg.ClientID = c.msg.ClientID
+	msg.ConnID = c.msg.ConnID
+	msg.PoolerID = c.msg.PoolerID
+	msg.RequestID = c.msg.RequestID
+	return c.service.broker.Publish(ctx, ResponsesChannel, msg)
+}
+
+// SendToUser sends data to every connection of userID, tagged with the
+// request ID.
+func (c *Context) SendToUser(userID string, data any) error {
+	return c.service.SendToUser(c, userID, data)
+}
+
+// Broadcast sends data to every connection on every pooler, tagged with
+// the request ID.
+func (c *Context) Broadcast(data any) error {
+	return c.service.Broadcast(c, data)
+}
+
+// Publish publishes msg on any channel.
+func (c *Context) Publish(channel string, msg broker.Message) error {
+	return c.service.Publish(c, channel, msg)
+}
@@ -0,0 +1,48 @@
+package sdk
+
+import "fmt"
+
+// Error codes sent by the SDK itself. Services add their own.
+const (
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeUnknownType    = "unknown_type"
+	ErrorCodeInternal       = "internal_error"
+)
+
+// Error is a failure to report to the client. A handler returns it to
+// have it sent as an ErrorFrame. Err, when set, is the cause; it is logged
+// but never shown to the client.
+type Error struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+// Errorf returns an Error with a formatted message.
+func Errorf(code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Internal reports an unexpected err to the client as internal_error with
+// message.
+func Internal(err error, message string) *Error {
+	return &Error{Code: ErrorCodeInternal, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// ErrorFrame is an Error as written to the client. It has the same shape
+// as the pooler's error frames.
+type ErrorFrame struct {
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
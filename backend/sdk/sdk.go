@@ -0,0 +1,453 @@
+// Package sdk is a library for writing backend services against the hub.
+// A Service subscribes to request channels, dispatches each client request
+// by type to a registered handler and hands it a Context that knows who
+// sent the request and how to answer it. It also limits how many requests
+// run at once and drains the ones in flight on shutdown.
+//
+// A minimal service:
+//
+//	svc := sdk.New(mb, sdk.Options{Channels: []string{"chat-requests"}})
+//	sdk.Handle(svc, "chat.send", func(c *sdk.Context, req SendRequest) error {
+//		if req.Text == "" {
+//			return sdk.Errorf(sdk.ErrorCodeInvalidRequest, "text is required")
+//		}
+//		return c.Reply(SendAck{Type: "chat.sent"})
+//	})
+//	err := svc.Run(ctx)
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wailbentafat/ws-hub/backend/broker"
+	"github.com/wailbentafat/ws-hub/backend/logging"
+	"github.com/wailbentafat/ws-hub/backend/tracing"
+)
+
+const (
+	// DefaultRequestsChannel is where poolers publish client requests
+	// unless they route them by service.
+	DefaultRequestsChannel = "backend-requests"
+	// ResponsesChannel is where every pooler listens for messages to its
+	// clients.
+	ResponsesChannel = "backend-responses"
+)
+
+// DefaultHandlerTimeout bounds a handler unless Options says otherwise.
+const DefaultHandlerTimeout = 30 * time.Second
+
+// errorReplyTimeout bounds publishing the error frame of a failed request,
+// which may have failed because its handler ran out of time.
+const errorReplyTimeout = 5 * time.Second
+
+// Options configures a Service.
+type Options struct {
+	// Channels are the request channels the service answers. When empty it
+	// answers DefaultRequestsChannel.
+	Channels []string
+	// MaxConcurrency bounds the requests handled at once on each request
+	// channel. The default of 1 handles them in the order they were
+	// published. Event channels are always handled in order, one message
+	// at a time, so that a connection's disconnect never overtakes its
+	// connect.
+	MaxConcurrency int
+	// HandlerTimeout bounds the context of each handler.
+	HandlerTimeout time.Duration
+	// Logger is annotated with each message's correlation IDs and handed to
+	// its handler. It defaults to slog.Default.
+	Logger *slog.Logger
+}
+
+// HandlerFunc handles one message. An *Error it returns is sent to the
+// client as an error frame; any other error is logged and reported to the
+// client as internal_error.
+type HandlerFunc func(c *Context) error
+
+// Middleware wraps the handler of every request, for example to record
+// requests before they are handled.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Service dispatches the messages of its channels to handlers. Handlers
+// must be registered before Run.
+type Service struct {
+	broker     broker.MessageBroker
+	opts       Options
+	handlers   map[string]HandlerFunc
+	fallback   HandlerFunc
+	binary     HandlerFunc
+	events     map[string]HandlerFunc
+	middleware []Middleware
+	running    atomic.Bool
+}
+
+func New(mb broker.MessageBroker, opts Options) *Service {
+	if len(opts.Channels) == 0 {
+		opts.Channels = []string{DefaultRequestsChannel}
+	}
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = 1
+	}
+	if opts.HandlerTimeout <= 0 {
+		opts.HandlerTimeout = DefaultHandlerTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Service{
+		broker:   mb,
+		opts:     opts,
+		handlers: make(map[string]HandlerFunc),
+		events:   make(map[string]HandlerFunc),
+	}
+}
+
+// Handle registers fn for requests of requestType, decoding their data
+// into a T. Data that does not decode is answered with invalid_request.
+func Handle[T any](s *Service, requestType string, fn func(c *Context, req T) error) {
+	s.HandleRaw(requestType, func(c *Context) error {
+		var req T
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+		return fn(c, req)
+	})
+}
+
+// HandleRaw registers fn for requests of requestType, which reads the data
+// itself.
+func (s *Service) HandleRaw(requestType string, fn HandlerFunc) {
+	s.mustNotRun()
+	if requestType == "" {
+		panic("sdk: empty request type")
+	}
+	if _, dup := s.handlers[requestType]; dup {
+		panic("sdk: multiple handlers for request type " + requestType)
+	}
+	s.handlers[requestType] = fn
+}
+
+// HandleDefault registers fn for requests of unregistered types and for
+// text that is not a JSON object. Without it such requests are answered
+// with unknown_type or invalid_request.
+func (s *Service) HandleDefault(fn HandlerFunc) {
+	s.mustNotRun()
+	s.fallback = fn
+}
+
+// HandleBinary registers fn for binary frames, whose payload is
+// Context.Binary. Without it they go to the default handler.
+func (s *Service) HandleBinary(fn HandlerFunc) {
+	s.mustNotRun()
+	s.binary = fn
+}
+
+// HandleEvents subscribes fn to a channel of events that are not client
+// requests, such as the poolers' presence events. Errors are logged; there
+// is no one to answer.
+func (s *Service) HandleEvents(channel string, fn HandlerFunc) {
+	s.mustNotRun()
+	if _, dup := s.events[channel]; dup {
+		panic("sdk: multiple handlers for channel " + channel)
+	}
+	s.events[channel] = fn
+}
+
+// Use adds middleware around every request handler, including the default
+// and binary ones. The first middleware added runs first.
+func (s *Service) Use(mw ...Middleware) {
+	s.mustNotRun()
+	s.middleware = append(s.middleware, mw...)
+}
+
+func (s *Service) mustNotRun() {
+	if s.running.Load() {
+		panic("sdk: handler registered after Run")
+	}
+}
+
+// Channels returns every channel Run subscribes to: the request channels,
+// then the event channels.
+func (s *Service) Channels() []string {
+	channels := append([]string(nil), s.opts.Channels...)
+	return append(channels, slices.Sorted(maps.Keys(s.events))...)
+}
+
+// SendToUser sends data to every connection of userID on every pooler,
+// tagged with the request ID of ctx if it has one.
+func (s *Service) SendToUser(ctx context.Context, userID string, data any) error {
+	return s.broker.Publish(ctx, ResponsesChannel, broker.Message{
+		ClientID:  userID,
+		Data:      data,
+		RequestID: RequestIDFromContext(ctx),
+	})
+}
+
+// Broadcast sends data to every connection on every pooler.
+func (s *Service) Broadcast(ctx context.Context, data any) error {
+	return s.broker.Publish(ctx, ResponsesChannel, broker.Message{
+		Data:      data,
+		RequestID: RequestIDFromContext(ctx),
+		Broadcast: true,
+	})
+}
+
+// Publish publishes msg on any channel, for example to hand a request to
+// another service.
+func (s *Service) Publish(ctx context.Context, channel string, msg broker.Message) error {
+	return s.broker.Publish(ctx, channel, msg)
+}
+
+// errSubscriptionClosed is returned by Run when a channel stops delivering
+// before ctx is done.
+var errSubscriptionClosed = errors.New("subscription closed")
+
+// Run subscribes to the service's channels and handles their messages
+// until ctx is done or a subscription closes, which it reports as an
+// error. Either way it stops taking messages and waits for the handlers
+// in flight, which keep running on a context that is not cancelled with
+// ctx.
+func (s *Service) Run(ctx context.Context) error {
+	if s.running.Swap(true) {
+		return errors.New("sdk: service is already running")
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	type subscription struct {
+		channel     string
+		messages    <-chan broker.Message
+		handler     func(context.Context, string, broker.Message)
+		concurrency int
+	}
+	var subs []subscription
+	for _, channel := range s.opts.Channels {
+		messages, err := s.broker.Subscribe(runCtx, channel)
+		if err != nil {
+			return fmt.Errorf("subscribe to %s: %w", channel, err)
+		}
+		subs = append(subs, subscription{channel, messages, s.handleRequest, s.opts.MaxConcurrency})
+	}
+	for _, channel := range slices.Sorted(maps.Keys(s.events)) {
+		fn := s.events[channel]
+		messages, err := s.broker.Subscribe(runCtx, channel)
+		if err != nil {
+			return fmt.Errorf("subscribe to %s: %w", channel, err)
+		}
+		subs = append(subs, subscription{channel, messages, s.eventHandler(fn), 1})
+	}
+
+	var (
+		wg       sync.WaitGroup
+		failOnce sync.Once
+		failure  error
+	)
+	for _, sub := range subs {
+		s.opts.Logger.Info("Subscribed to channel", "channel", sub.channel)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.consume(runCtx, sub.channel, sub.messages, sub.handler, sub.concurrency)
+			if runCtx.Err() == nil {
+				failOnce.Do(func() { failure = fmt.Errorf("%s: %w", sub.channel, errSubscriptionClosed) })
+				stop()
+			}
+		}()
+	}
+	wg.Wait()
+	return failure
+}
+
+// consume hands the messages of one channel to handler, at most
+// concurrency at a time, and returns once the channel is done and every
+// handler it started has returned.
+func (s *Service) consume(ctx context.Context, channel string, messages <-chan broker.Message, handler func(context.Context, string, broker.Message), concurrency int) {
+	handlerCtx := context.WithoutCancel(ctx)
+	slots := make(chan struct{}, concurrency)
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			slots <- struct{}{}
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				defer func() { <-slots }()
+				handler(handlerCtx, channel, msg)
+			}()
+		}
+	}
+}
+
+// handleRequest finds the handler of a client request and runs it through
+// the middleware.
+func (s *Service) handleRequest(ctx context.Context, channel string, msg broker.Message) {
+	c, span, done := s.newContext(ctx, channel, msg, "backend.handle_request")
+	defer done()
+
+	if msg.Opcode == broker.OpcodeBinary {
+		c.Logger().Debug("Received binary request", logging.Payload(msg.Binary))
+		s.run(c, span, s.requestHandler(s.binary, c))
+		return
+	}
+
+	raw, err := msg.RawData()
+	if err != nil {
+		c.Logger().Error("Failed to read request data", "error", err)
+		return
+	}
+	c.raw = raw
+	c.Logger().Debug("Received request", logging.Payload(raw))
+
+	if msg.Type != "" {
+		// v2 clients name the type in the envelope and send the fields as
+		// data, which may be empty.
+		c.requestType = msg.Type
+		if len(raw) == 0 {
+			c.raw = []byte("{}")
+		}
+	} else {
+		var payload struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(raw, &payload) == nil {
+			c.requestType = payload.Type
+		} else {
+			c.structured = false
+		}
+	}
+	span.SetAttributes(attribute.String("wshub.request_type", c.requestType))
+
+	fn, ok := s.handlers[c.requestType]
+	if !ok {
+		fn = s.fallback
+	}
+	s.run(c, span, s.requestHandler(fn, c))
+}
+
+// requestHandler wraps fn, or the answer to a request nobody handles, in
+// the middleware.
+func (s *Service) requestHandler(fn HandlerFunc, c *Context) HandlerFunc {
+	if fn == nil {
+		fn = s.fallback
+	}
+	if fn == nil {
+		fn = unhandled
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		fn = s.middleware[i](fn)
+	}
+	return fn
+}
+
+// unhandled answers a request that no handler was registered for.
+func unhandled(c *Context) error {
+	switch {
+	case c.msg.Opcode == broker.OpcodeBinary:
+		return Errorf(ErrorCodeInvalidRequest, "Binary requests are not supported")
+	case !c.structured:
+		return Errorf(ErrorCodeInvalidRequest, "Request is not a JSON object")
+	case c.Type() == "":
+		return Errorf(ErrorCodeInvalidRequest, "Request type is missing")
+	}
+	return Errorf(ErrorCodeUnknownType, "Unknown request type %.64q", c.Type())
+}
+
+func (s *Service) eventHandler(fn HandlerFunc) func(context.Context, string, broker.Message) {
+	return func(ctx context.Context, channel string, msg broker.Message) {
+		c, span, done := s.newContext(ctx, channel, msg, "backend.handle_event")
+		defer done()
+		c.requestType = msg.Type
+		c.event = true
+		if raw, err := msg.RawData(); err == nil {
+			c.raw = raw
+		}
+		span.SetAttributes(attribute.String("wshub.event_type", msg.Type))
+		s.run(c, span, fn)
+	}
+}
+
+// newContext starts the span and timeout of one message. done ends both.
+func (s *Service) newContext(ctx context.Context, channel string, msg broker.Message, spanName string) (*Context, trace.Span, func()) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HandlerTimeout)
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Trace), spanName,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("wshub.client_id", msg.ClientID),
+			attribute.String("wshub.channel", channel),
+		),
+	)
+	c := &Context{
+		Context:    WithRequestID(ctx, msg.RequestID),
+		service:    s,
+		channel:    channel,
+		msg:        msg,
+		structured: true,
+		log: s.opts.Logger.With(
+			"client_id", msg.ClientID,
+			"conn_id", msg.ConnID,
+			"pooler_id", msg.PoolerID,
+			"request_id", msg.RequestID,
+		),
+	}
+	return c, span, func() {
+		span.End()
+		cancel()
+	}
+}
+
+// run calls fn and reports what it returns: an *Error is sent to the
+// client, anything else is logged and sent as internal_error. Events are
+// only logged. A panicking handler counts as a failed one.
+func (s *Service) run(c *Context, span trace.Span, fn HandlerFunc) {
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("handler panicked: %v\n%s", p, debug.Stack())
+			}
+		}()
+		return fn(c)
+	}()
+	if err == nil {
+		return
+	}
+
+	var reply *Error
+	if !errors.As(err, &reply) || reply.Err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.Logger().Error("Handler failed", "type", c.Type(), "channel", c.Channel(), "error", err)
+	}
+	if c.event {
+		return
+	}
+	if reply == nil {
+		reply = &Error{Code: ErrorCodeInternal, Message: "Request failed"}
+	}
+	// The handler's context may be done; the client still gets the error.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Context), errorReplyTimeout)
+	defer cancel()
+	if err := c.replyError(ctx, reply.Code, reply.Message); err != nil {
+		c.Logger().Error("Failed to publish error", "error", err)
+	}
+}
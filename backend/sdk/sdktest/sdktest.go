@@ -0,0 +1,298 @@
+// Package sdktest runs sdk services against an in-memory broker, so that
+// their handlers can be tested without Redis or a pooler.
+package sdktest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/wailbentafat/ws-hub/backend/broker"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+// Timeout bounds how long the helpers wait for a service.
+var Timeout = 5 * time.Second
+
+var errClosed = errors.New("sdktest: broker closed")
+
+// Broker is an in-memory broker.MessageBroker. Messages go through the
+// JSON codec, so handlers see them as they would arrive from Redis, and
+// are never dropped: each subscription queues what it has not read yet.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[string][]*subscription
+	closed bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string][]*subscription)}
+}
+
+type subscription struct {
+	mu     sync.Mutex
+	queue  []broker.Message
+	wake   chan struct{}
+	cancel context.CancelFunc
+}
+
+// Publish fails once ctx is done, as a publish to Redis would.
+func (b *Broker) Publish(ctx context.Context, channel string, message broker.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := broker.Encode(broker.JSONCodec, message)
+	if err != nil {
+		return err
+	}
+	var decoded broker.Message
+	if err := broker.Decode(payload, &decoded); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errClosed
+	}
+	for _, sub := range b.subs[channel] {
+		sub.mu.Lock()
+		sub.queue = append(sub.queue, decoded)
+		sub.mu.Unlock()
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers the messages published on channel until ctx is done
+// or the broker is closed.
+func (b *Broker) Subscribe(ctx context.Context, channel string) (<-chan broker.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{wake: make(chan struct{}, 1), cancel: cancel}
+	b.subs[channel] = append(b.subs[channel], sub)
+
+	messages := make(chan broker.Message)
+	go func() {
+		defer close(messages)
+		defer b.unsubscribe(channel, sub)
+		for {
+			sub.mu.Lock()
+			queue := sub.queue
+			sub.queue = nil
+			sub.mu.Unlock()
+			for _, msg := range queue {
+				select {
+				case messages <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-sub.wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func (b *Broker) unsubscribe(channel string, sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subs := b.subs[channel]
+	for i, s := range subs {
+		if s == sub {
+			b.subs[channel] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Subscribers counts the active subscriptions to channel.
+func (b *Broker) Subscribers(channel string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[channel])
+}
+
+func (b *Broker) Ping(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// Close ends every subscription, which stops the services using b.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, subs := range b.subs {
+		for _, sub := range subs {
+			sub.cancel()
+		}
+	}
+	return nil
+}
+
+// Run runs svc until the test ends, returning once it has subscribed to
+// all of its channels. The test fails if Run returns an error.
+func Run(t testing.TB, b *Broker, svc *sdk.Service) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("service stopped: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(Timeout)
+	for _, channel := range svc.Channels() {
+		for b.Subscribers(channel) == 0 {
+			select {
+			case err := <-done:
+				done <- err
+				t.Fatalf("service stopped before subscribing to %s: %v", channel, err)
+			default:
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("service did not subscribe to %s", channel)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Client stands in for one connection of a user: it sends requests as a
+// pooler would and receives the messages addressed to it.
+type Client struct {
+	ID     string
+	ConnID string
+	// Claims are stamped on every request.
+	Claims   map[string]any
+	broker   *Broker
+	messages <-chan broker.Message
+}
+
+// NewClient connects userID. Messages published before it exists are not
+// received.
+func NewClient(t testing.TB, b *Broker, userID string) *Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	messages, err := b.Subscribe(ctx, sdk.ResponsesChannel)
+	if err != nil {
+		t.Fatalf("subscribe client %s: %v", userID, err)
+	}
+	return &Client{
+		ID:       userID,
+		ConnID:   uuid.NewString(),
+		Claims:   map[string]any{"sub": userID},
+		broker:   b,
+		messages: messages,
+	}
+}
+
+// Send publishes a request on sdk.DefaultRequestsChannel and returns its
+// request ID. A string is sent as is, like the text frame of a v1 client;
+// anything else is encoded as JSON first.
+func (c *Client) Send(t testing.TB, request any) string {
+	t.Helper()
+	return c.SendTo(t, sdk.DefaultRequestsChannel, request)
+}
+
+// SendTo publishes a request on channel and returns its request ID.
+func (c *Client) SendTo(t testing.TB, channel string, request any) string {
+	t.Helper()
+	data, ok := request.(string)
+	if !ok {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("encode request: %v", err)
+		}
+		data = string(encoded)
+	}
+	msg := c.message()
+	msg.Data = data
+	return c.publish(t, channel, msg)
+}
+
+// SendBinary publishes a binary request and returns its request ID.
+func (c *Client) SendBinary(t testing.TB, payload []byte) string {
+	t.Helper()
+	msg := c.message()
+	msg.Opcode = broker.OpcodeBinary
+	msg.Binary = payload
+	return c.publish(t, sdk.DefaultRequestsChannel, msg)
+}
+
+func (c *Client) message() broker.Message {
+	return broker.Message{
+		ClientID:  c.ID,
+		ConnID:    c.ConnID,
+		PoolerID:  "sdktest",
+		RequestID: uuid.NewString(),
+		Claims:    c.Claims,
+	}
+}
+
+func (c *Client) publish(t testing.TB, channel string, msg broker.Message) string {
+	t.Helper()
+	if err := c.broker.Publish(context.Background(), channel, msg); err != nil {
+		t.Fatalf("publish request: %v", err)
+	}
+	return msg.RequestID
+}
+
+// Next returns the next message addressed to the client: one for its
+// user without a connection, one for its connection, or a broadcast.
+func (c *Client) Next(t testing.TB) broker.Message {
+	t.Helper()
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("client %s: broker closed", c.ID)
+			}
+			if msg.Broadcast || msg.ClientID == c.ID && (msg.ConnID == "" || msg.ConnID == c.ConnID) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("client %s: no message within %s", c.ID, Timeout)
+		}
+	}
+}
+
+// NextJSON decodes the data of the next message into v.
+func (c *Client) NextJSON(t testing.TB, v any) broker.Message {
+	t.Helper()
+	msg := c.Next(t)
+	raw, err := msg.RawData()
+	if err != nil {
+		t.Fatalf("client %s: read message: %v", c.ID, err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		t.Fatalf("client %s: decode %s: %v", c.ID, raw, err)
+	}
+	return msg
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	directMessagesKeyPrefix = "dm:messages:"
+	// cursorsKeyPrefix prefixes the hashes mapping each participant of a
+	// conversation to the ID of the last message they received or read.
+	cursorsKeyPrefix = "cursor:"
+)
+
+// Cursor kinds. Every message up to a participant's cursor has been
+// delivered to, or read by, one of their clients.
+const (
+	CursorDelivered = "delivered"
+	CursorRead      = "read"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// Conversation identifies a room or the direct conversation between two
+// users. Its key is the same for both participants.
+type Conversation struct {
+	RoomID string
+	// Users are the two participants of a direct conversation, in order.
+	Users [2]string
+}
+
+func RoomConversation(roomID string) Conversation {
+	return Conversation{RoomID: roomID}
+}
+
+func DirectConversation(a, b string) Conversation {
+	if b < a {
+		a, b = b, a
+	}
+	return Conversation{Users: [2]string{a, b}}
+}
+
+// key names the conversation within the key space. User IDs are length
+// prefixed because they may contain any character.
+func (c Conversation) key() string {
+	if c.RoomID != "" {
+		return "room:" + c.RoomID
+	}
+	return fmt.Sprintf("dm:%d:%s:%s", len(c.Users[0]), c.Users[0], c.Users[1])
+}
+
+func (c Conversation) messagesKey() string {
+	if c.RoomID != "" {
+		_, _, messages := roomKeys(c.RoomID)
+		return messages
+	}
+	return directMessagesKeyPrefix + c.key()
+}
+
+// advanceCursorScript moves a cursor forward, never back. Stream IDs
+// compare by their millisecond and sequence parts.
+var advanceCursorScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if cur then
+	local cms, cseq = string.match(cur, '^(%d+)-(%d+)$')
+	local nms, nseq = string.match(ARGV[2], '^(%d+)-(%d+)$')
+	cms, cseq, nms, nseq = tonumber(cms), tonumber(cseq), tonumber(nms), tonumber(nseq)
+	if nms < cms or (nms == cms and nseq <= cseq) then
+		return 0
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// AppendDirectMessage adds msg to the history of its conversation and sets
+// its ID, which orders it like room messages do.
+func (s *Store) AppendDirectMessage(ctx context.Context, msg *DirectMessage) (err error) {
+	ctx, span := startSpan(ctx, "append_direct_message")
+	defer func() { endSpan(span, err) }()
+
+	msg.ID, err = s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: DirectConversation(msg.From, msg.To).messagesKey(),
+		MaxLen: s.roomHistoryLimit,
+		Approx: true,
+		Values: map[string]interface{}{
+			"from":    msg.From,
+			"body":    string(msg.Body),
+			"sent_at": msg.SentAt.UnixMilli(),
+		},
+	}).Result()
+	return err
+}
+
+// ConversationMessage looks up one message of a conversation by ID. It
+// returns ErrMessageNotFound once the message has been trimmed.
+func (s *Store) ConversationMessage(ctx context.Context, conv Conversation, id string) (msg RoomMessage, err error) {
+	ctx, span := startSpan(ctx, "conversation_message")
+	defer func() { endSpan(span, err) }()
+
+	entries, err := s.rdb.XRangeN(ctx, conv.messagesKey(), id, id, 1).Result()
+	if err != nil {
+		return RoomMessage{}, err
+	}
+	if len(entries) == 0 {
+		return RoomMessage{}, ErrMessageNotFound
+	}
+	return decodeMessage(entries[0], conv.RoomID), nil
+}
+
+// SharesConversation reports whether a and b are members of a common room
+// or have exchanged direct messages.
+func (s *Store) SharesConversation(ctx context.Context, a, b string) (shared bool, err error) {
+	ctx, span := startSpan(ctx, "shares_conversation")
+	defer func() { endSpan(span, err) }()
+
+	var rooms *redis.StringSliceCmd
+	var direct *redis.IntCmd
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		rooms = pipe.SInter(ctx, userRoomsKeyPrefix+a, userRoomsKeyPrefix+b)
+		direct = pipe.Exists(ctx, DirectConversation(a, b).messagesKey())
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(rooms.Val()) > 0 || direct.Val() > 0, nil
+}
+
+func cursorsKey(kind string, conv Conversation) string {
+	return cursorsKeyPrefix + kind + ":" + conv.key()
+}
+
+// AdvanceCursor moves userID's cursor of the given kind up to id. It
+// reports false when the cursor was already at or past id.
+func (s *Store) AdvanceCursor(ctx context.Context, kind string, conv Conversation, userID, id string) (advanced bool, err error) {
+	ctx, span := startSpan(ctx, "advance_cursor")
+	defer func() { endSpan(span, err) }()
+
+	n, err := advanceCursorScript.Run(ctx, s.rdb, []string{cursorsKey(kind, conv)}, userID, id).Int()
+	return n == 1, err
+}
+
+// Cursors returns every participant's cursor of the given kind.
+func (s *Store) Cursors(ctx context.Context, kind string, conv Conversation) (cursors map[string]string, err error) {
+	ctx, span := startSpan(ctx, "cursors")
+	defer func() { endSpan(span, err) }()
+
+	return s.rdb.HGetAll(ctx, cursorsKey(kind, conv)).Result()
+}
+
+// decodeMessage turns a stream entry into a message of roomID, which is
+// empty for direct conversations.
+func decodeMessage(entry redis.XMessage, roomID string) RoomMessage {
+	body, _ := entry.Values["body"].(string)
+	from, _ := entry.Values["from"].(string)
+	sentAtMs, _ := entry.Values["sent_at"].(string)
+	sentAt, _ := strconv.ParseInt(sentAtMs, 10, 64)
+	return RoomMessage{
+		ID:     entry.ID,
+		RoomID: roomID,
+		From:   from,
+		Body:   json.RawMessage(body),
+		SentAt: time.UnixMilli(sentAt).UTC(),
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+// maxUserIDLength bounds the recipient of a direct message. Longer IDs
+// cannot come from a token the pooler accepted.
+const maxUserIDLength = 256
+
+// Error codes sent back to clients in error frames.
+const (
+	ErrorCodeInvalidRequest   = sdk.ErrorCodeInvalidRequest
+	ErrorCodeInvalidRecipient = "invalid_recipient"
+	ErrorCodeRecipientOffline = "recipient_offline"
+	ErrorCodeInternal         = sdk.ErrorCodeInternal
+)
+
+// SendDirectRequest asks for Body to be delivered to every connection of
+// user To. ClientMsgID is an optional sender-chosen ID echoed on the receipt.
+type SendDirectRequest struct {
+	Type        string          `json:"type"`
+	To          string          `json:"to"`
+	Body        json.RawMessage `json:"body"`
+	ClientMsgID string          `json:"client_msg_id,omitempty"`
+}
+
+// DirectMessage is the frame written to the recipient. From is the
+// authenticated sender, never a value taken from the request.
+type DirectMessage struct {
+	Type   string          `json:"type"`
+	ID     string          `json:"id"`
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Body   json.RawMessage `json:"body"`
+	SentAt time.Time       `json:"sent_at"`
+}
+
+// DeliveryReceipt tells the sender that a direct message was stored and
+// handed to the recipient's poolers. Delivery to a client and reading it
+// are reported later with MessageStatus.
+type DeliveryReceipt struct {
+	Type        string    `json:"type"`
+	ID          string    `json:"id"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	To          string    `json:"to"`
+	Status      string    `json:"status"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+func handleSendDirect(c *sdk.Context, store *Store, req SendDirectRequest) error {
+	switch {
+	case req.To == "" || len(req.To) > maxUserIDLength:
+		return sdk.Errorf(ErrorCodeInvalidRecipient, "Recipient is missing or invalid")
+	case req.To == c.ClientID():
+		return sdk.Errorf(ErrorCodeInvalidRecipient, "Cannot send a direct message to yourself")
+	case len(req.Body) == 0 || string(req.Body) == "null":
+		return sdk.Errorf(ErrorCodeInvalidRequest, "Message body is required")
+	}
+
+	online, err := store.IsOnline(c, req.To)
+	if err != nil {
+		return sdk.Internal(fmt.Errorf("look up recipient %s: %w", req.To, err), "Could not deliver message")
+	}
+	if !online {
+		return sdk.Errorf(ErrorCodeRecipientOffline, "Recipient is not online")
+	}
+
+	dm := DirectMessage{
+		Type:   "direct_message",
+		From:   c.ClientID(),
+		To:     req.To,
+		Body:   req.Body,
+		SentAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := store.AppendDirectMessage(c, &dm); err != nil {
+		return sdk.Internal(fmt.Errorf("store direct message to %s: %w", req.To, err), "Could not deliver message")
+	}
+	if err := c.SendToUser(req.To, dm); err != nil {
+		return sdk.Internal(fmt.Errorf("publish direct message to %s: %w", req.To, err), "Could not deliver message")
+	}
+	c.Logger().Info("Delivered direct message", "to", req.To, "message_id", dm.ID)
+
+	return c.Reply(DeliveryReceipt{
+		Type:        "delivery_receipt",
+		ID:          dm.ID,
+		ClientMsgID: req.ClientMsgID,
+		To:          req.To,
+		Status:      "sent",
+		SentAt:      dm.SentAt,
+	})
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+)
+
+const PresenceEventsChannel = "presence-events"
+
+// handlePresenceEvent keeps the presence store up to date and reports
+// connects and disconnects to hooks, which may be nil.
+func handlePresenceEvent(c *sdk.Context, store *Store, hooks *webhook.Dispatcher) error {
+	if hooks.Wants(c.Type()) {
+		hooks.Dispatch(webhook.NewEvent(c.Type(), c.ClientID(), c.ConnID(), c.PoolerID(), nil))
+	}
+
+	log := c.Logger()
+	switch c.Type() {
+	case "user_connected":
+		log.Info("User connected")
+		if err := store.AddOnlineUser(c, c.ClientID(), c.ConnID()); err != nil {
+			return fmt.Errorf("add online user: %w", err)
+		}
+		deliverQueuedPushes(c, store)
+	case "user_disconnected":
+		log.Info("User disconnected")
+		if err := store.RemoveOnlineUser(c, c.ClientID(), c.ConnID()); err != nil {
+			return fmt.Errorf("remove online user: %w", err)
+		}
+	case "user_idle", "user_active":
+		log.Debug("Connection activity changed", "type", c.Type())
+		if err := store.SetConnIdle(c, c.ClientID(), c.ConnID(), c.Type() == "user_idle"); err != nil {
+			return fmt.Errorf("update idle connections: %w", err)
+		}
+	default:
+		log.Warn("Unknown event type received", "type", c.Type())
+	}
+	return nil
+}
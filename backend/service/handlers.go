@@ -0,0 +1,107 @@
+// Package service implements the backend: it answers client requests
+// forwarded by the poolers and keeps the presence store up to date. It is
+// built on the sdk package; Register adds its handlers to an sdk.Service.
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/wailbentafat/ws-hub/backend/logging"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+)
+
+const (
+	BackendRequestsChannel  = sdk.DefaultRequestsChannel
+	BackendResponsesChannel = sdk.ResponsesChannel
+)
+
+// Register adds the backend's request handlers to svc, along with its
+// handlers for presence events and signals. Requests of the types hooks
+// subscribes to are also reported as message events once handled
+// successfully, and connects and disconnects as connection events; hooks
+// may be nil. Requests of other types are echoed back.
+func Register(svc *sdk.Service, store *Store, hooks *webhook.Dispatcher) {
+	svc.Use(messageEvents(hooks))
+	svc.HandleDefault(echo)
+	svc.HandleBinary(echoBinary)
+
+	svc.HandleRaw("get_online_users", func(c *sdk.Context) error {
+		users, err := store.GetOnlineUsers(c)
+		if err != nil {
+			return sdk.Internal(err, "Failed to get online users")
+		}
+		return c.Reply(map[string]interface{}{
+			"type":  "online_users_list",
+			"users": users,
+		})
+	})
+	sdk.Handle(svc, "send_direct", func(c *sdk.Context, req SendDirectRequest) error {
+		return handleSendDirect(c, store, req)
+	})
+	for _, requestType := range roomRequestTypes {
+		sdk.Handle(svc, requestType, func(c *sdk.Context, req RoomRequest) error {
+			return handleRoomRequest(c, store, req)
+		})
+	}
+	for _, requestType := range presenceRequestTypes {
+		sdk.Handle(svc, requestType, func(c *sdk.Context, req PresenceRequest) error {
+			return handlePresenceRequest(c, store, req)
+		})
+	}
+	for _, requestType := range receiptRequestTypes {
+		sdk.Handle(svc, requestType, func(c *sdk.Context, req ReceiptRequest) error {
+			return handleReceiptRequest(c, store, req)
+		})
+	}
+
+	svc.HandleEvents(PresenceEventsChannel, func(c *sdk.Context) error {
+		return handlePresenceEvent(c, store, hooks)
+	})
+	svc.HandleEvents(SignalEventsChannel, func(c *sdk.Context) error {
+		return relaySignal(c, store)
+	})
+}
+
+// messageEvents reports requests to hooks once they have been handled
+// without error, so that rejected requests are not reported.
+func messageEvents(hooks *webhook.Dispatcher) sdk.Middleware {
+	return func(next sdk.HandlerFunc) sdk.HandlerFunc {
+		return func(c *sdk.Context) error {
+			if err := next(c); err != nil {
+				return err
+			}
+			event := webhook.MessageEvent(c.Type())
+			if c.Type() == "" || !hooks.Wants(event) {
+				return nil
+			}
+			data, err := eventData(c)
+			if err != nil {
+				c.Logger().Warn("Failed to encode message event", "event", event, "error", err)
+				return nil
+			}
+			hooks.Dispatch(webhook.NewEvent(event, c.ClientID(), c.ConnID(), c.PoolerID(), data))
+			return nil
+		}
+	}
+}
+
+// eventData is the request data as JSON. Data that is not JSON, such as a
+// string sent by a v2 client, is encoded as a JSON value.
+func eventData(c *sdk.Context) (json.RawMessage, error) {
+	if raw := c.Data(); json.Valid(raw) {
+		return raw, nil
+	}
+	return json.Marshal(c.Message().Data)
+}
+
+// echo answers requests the backend does not know with their own data.
+func echo(c *sdk.Context) error {
+	c.Logger().Debug("Unknown request, echoing back", "type", c.Type())
+	return c.Reply(c.Message().Data)
+}
+
+func echoBinary(c *sdk.Context) error {
+	c.Logger().Debug("Received binary request, echoing back", logging.Payload(c.Binary()))
+	return c.ReplyBinary(c.Binary())
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/backend/broker"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// Health tracks the listener goroutines and broker connectivity of the
+// backend and serves them as /healthz and /readyz.
+type Health struct {
+	broker    broker.MessageBroker
+	draining  atomic.Bool
+	mu        sync.Mutex
+	listeners map[string]bool
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func NewHealth(mb broker.MessageBroker) *Health {
+	return &Health{
+		broker:    mb,
+		listeners: make(map[string]bool),
+	}
+}
+
+// Go runs a listener in its own goroutine and reports it as not ready
+// once it returns, which happens when its subscription channel closes.
+func (h *Health) Go(name string, listener func()) {
+	h.setListener(name, true)
+	go func() {
+		defer h.setListener(name, false)
+		listener()
+	}()
+}
+
+func (h *Health) setListener(name string, alive bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners[name] = alive
+}
+
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+func (h *Health) check(ctx context.Context) map[string]string {
+	failed := make(map[string]string)
+
+	h.mu.Lock()
+	for name, alive := range h.listeners {
+		if !alive {
+			failed[name] = fmt.Sprintf("%s listener has exited", name)
+		}
+	}
+	h.mu.Unlock()
+
+	if err := h.broker.Ping(ctx); err != nil {
+		failed["redis"] = err.Error()
+	}
+	return failed
+}
+
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if h.draining.Load() {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "draining"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		defer cancel()
+
+		if failed := h.check(ctx); len(failed) > 0 {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not_ready", Checks: failed})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ready"})
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Failed to write health response", "error", err)
+	}
+}
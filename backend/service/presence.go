@@ -0,0 +1,65 @@
+package service
+
+import (
+	"unicode/utf8"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+const (
+	// maxStatusTextLength bounds custom status text, in characters.
+	maxStatusTextLength = 140
+	// MaxPresenceUsers bounds the users a single get_presence asks about.
+	MaxPresenceUsers = 100
+)
+
+// PresenceRequest is a set_status or get_presence frame.
+type PresenceRequest struct {
+	Status string   `json:"status"`
+	Text   string   `json:"text"`
+	Users  []string `json:"users"`
+}
+
+// PresenceList answers get_presence, and set_status with the caller's own
+// presence.
+type PresenceList struct {
+	Type  string     `json:"type"`
+	Users []Presence `json:"users"`
+}
+
+// presenceRequestTypes are the request types handled by
+// handlePresenceRequest.
+var presenceRequestTypes = []string{"set_status", "get_presence"}
+
+func handlePresenceRequest(c *sdk.Context, store *Store, req PresenceRequest) error {
+	users := req.Users
+	if c.Type() == "set_status" {
+		switch req.Status {
+		case StatusAvailable, StatusAway, StatusDND:
+		default:
+			return sdk.Errorf(ErrorCodeInvalidRequest, "status must be available, away or dnd")
+		}
+		if utf8.RuneCountInString(req.Text) > maxStatusTextLength {
+			return sdk.Errorf(ErrorCodeInvalidRequest, "Status text is too long")
+		}
+		if err := store.SetStatus(c, c.ClientID(), req.Status, req.Text); err != nil {
+			return sdk.Internal(err, "Failed to set status")
+		}
+		users = []string{c.ClientID()}
+	} else {
+		if len(users) == 0 || len(users) > MaxPresenceUsers {
+			return sdk.Errorf(ErrorCodeInvalidRequest, "users must list between 1 and 100 users")
+		}
+		for _, userID := range users {
+			if userID == "" || len(userID) > maxUserIDLength {
+				return sdk.Errorf(ErrorCodeInvalidRequest, "users contains an invalid user ID")
+			}
+		}
+	}
+
+	presence, err := store.GetPresence(c, users)
+	if err != nil {
+		return sdk.Internal(err, "Failed to get presence")
+	}
+	return c.Reply(PresenceList{Type: "presence", Users: presence})
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// idleConnsKeyPrefix prefixes the per-user set of connections that the
+	// pooler reported idle.
+	idleConnsKeyPrefix = "presence:idle:"
+	// statusKeyPrefix prefixes the hash holding the status a user set.
+	statusKeyPrefix = "presence:status:"
+	// lastSeenKey maps each user to when one of their connections last
+	// closed, in milliseconds.
+	lastSeenKey = "presence:last_seen"
+)
+
+// Presence statuses. Users set available, away or dnd; offline is derived
+// from their connections.
+const (
+	StatusAvailable = "available"
+	StatusAway      = "away"
+	StatusDND       = "dnd"
+	StatusOffline   = "offline"
+)
+
+// Presence describes one user. A user whose every connection is idle is
+// reported away unless they chose a status other than available.
+type Presence struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+	// Text is the custom status text the user set, if any.
+	Text string `json:"text,omitempty"`
+	// LastSeen is when the user's last connection closed. It is only set
+	// for offline users who have been seen.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Devices  int64      `json:"devices"`
+}
+
+// markIdleScript records an idle connection, unless the connection has
+// already closed.
+var markIdleScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[1], ARGV[1]) == 1 then
+	return redis.call('SADD', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// SetConnIdle records whether one connection of the user is idle.
+func (s *Store) SetConnIdle(ctx context.Context, userID, connID string, idle bool) (err error) {
+	ctx, span := startSpan(ctx, "set_conn_idle")
+	defer func() { endSpan(span, err) }()
+
+	if !idle {
+		return s.rdb.SRem(ctx, idleConnsKeyPrefix+userID, connID).Err()
+	}
+	keys := []string{userConnsKeyPrefix + userID, idleConnsKeyPrefix + userID}
+	return markIdleScript.Run(ctx, s.rdb, keys, connID).Err()
+}
+
+// SetStatus stores the status a user chose. It outlives their connections.
+func (s *Store) SetStatus(ctx context.Context, userID, status, text string) (err error) {
+	ctx, span := startSpan(ctx, "set_status")
+	defer func() { endSpan(span, err) }()
+
+	return s.rdb.HSet(ctx, statusKeyPrefix+userID,
+		"status", status,
+		"text", text,
+		"updated_at", time.Now().UnixMilli(),
+	).Err()
+}
+
+// GetPresence returns the presence of each user, in order, reading all of
+// them in one round trip.
+func (s *Store) GetPresence(ctx context.Context, userIDs []string) (presence []Presence, err error) {
+	ctx, span := startSpan(ctx, "get_presence")
+	defer func() { endSpan(span, err) }()
+
+	if len(userIDs) == 0 {
+		return []Presence{}, nil
+	}
+
+	statuses := make([]*redis.StringStringMapCmd, len(userIDs))
+	devices := make([]*redis.IntCmd, len(userIDs))
+	idle := make([]*redis.IntCmd, len(userIDs))
+	var lastSeen *redis.SliceCmd
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			statuses[i] = pipe.HGetAll(ctx, statusKeyPrefix+userID)
+			devices[i] = pipe.SCard(ctx, userConnsKeyPrefix+userID)
+			idle[i] = pipe.SCard(ctx, idleConnsKeyPrefix+userID)
+		}
+		lastSeen = pipe.HMGet(ctx, lastSeenKey, userIDs...)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	seen := lastSeen.Val()
+	presence = make([]Presence, len(userIDs))
+	for i, userID := range userIDs {
+		chosen := statuses[i].Val()
+		p := Presence{
+			UserID:  userID,
+			Status:  chosen["status"],
+			Text:    chosen["text"],
+			Devices: devices[i].Val(),
+		}
+		switch {
+		case p.Devices == 0:
+			p.Status = StatusOffline
+			if ms, ok := seen[i].(string); ok {
+				if at, err := strconv.ParseInt(ms, 10, 64); err == nil {
+					t := time.UnixMilli(at).UTC()
+					p.LastSeen = &t
+				}
+			}
+		case p.Status == "" || p.Status == StatusAvailable:
+			p.Status = StatusAvailable
+			if idle[i].Val() >= p.Devices {
+				p.Status = StatusAway
+			}
+		}
+		presence[i] = p
+	}
+	return presence, nil
+}
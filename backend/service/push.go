@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+const (
+	// DefaultPushMaxDataBytes bounds the data of a push unless PushConfig
+	// says otherwise.
+	DefaultPushMaxDataBytes = 64 << 10
+	// MaxPushUsers bounds the users a single push lists.
+	MaxPushUsers = 1000
+	// maxPushEnvelopeBytes allows for the rest of a push body besides data.
+	maxPushEnvelopeBytes = 512 << 10
+)
+
+// PushConfig configures the push API.
+type PushConfig struct {
+	// Token is the bearer token other services authenticate with. The API
+	// is not served when it is empty.
+	Token string
+	// MaxDataBytes bounds the encoded data of a push.
+	MaxDataBytes int
+}
+
+// PushRequest is the body of POST /v1/push. Exactly one of User, Users,
+// Topic and Everyone names the recipients; a topic is a room and reaches
+// its members.
+type PushRequest struct {
+	User     string          `json:"user,omitempty"`
+	Users    []string        `json:"users,omitempty"`
+	Topic    string          `json:"topic,omitempty"`
+	Everyone bool            `json:"everyone,omitempty"`
+	Data     json.RawMessage `json:"data"`
+	// Queue keeps the push for recipients who are offline and delivers it
+	// when they next connect. It cannot be combined with Everyone.
+	Queue bool `json:"queue,omitempty"`
+}
+
+// PushResult reports who a push reached. Offline lists the recipients who
+// were not connected; they received it only if it was queued.
+type PushResult struct {
+	ID      string   `json:"id"`
+	Online  []string `json:"online"`
+	Offline []string `json:"offline"`
+	Queued  int      `json:"queued"`
+}
+
+// PushFrame is a push as written to clients.
+type PushFrame struct {
+	Type   string          `json:"type"`
+	ID     string          `json:"id"`
+	Topic  string          `json:"topic,omitempty"`
+	Data   json.RawMessage `json:"data"`
+	SentAt time.Time       `json:"sent_at"`
+}
+
+// PushAPI lets other internal services send to connected clients over HTTP
+// instead of publishing broker messages themselves.
+type PushAPI struct {
+	service *sdk.Service
+	store   *Store
+	cfg     PushConfig
+	mux     *http.ServeMux
+}
+
+func NewPushAPI(svc *sdk.Service, store *Store, cfg PushConfig) *PushAPI {
+	if cfg.MaxDataBytes <= 0 {
+		cfg.MaxDataBytes = DefaultPushMaxDataBytes
+	}
+	p := &PushAPI{service: svc, store: store, cfg: cfg, mux: http.NewServeMux()}
+	p.mux.HandleFunc("POST /v1/push", p.push)
+	return p
+}
+
+func (p *PushAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "Invalid push token")
+		return
+	}
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *PushAPI) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && p.cfg.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(p.cfg.Token)) == 1
+}
+
+func (p *PushAPI) push(w http.ResponseWriter, r *http.Request) {
+	limit := int64(p.cfg.MaxDataBytes + maxPushEnvelopeBytes)
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	if int64(len(body)) > limit {
+		writeError(w, http.StatusRequestEntityTooLarge, "Push too large")
+		return
+	}
+	var req PushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed push: "+err.Error())
+		return
+	}
+	if problem := validatePush(req); problem != "" {
+		writeError(w, http.StatusBadRequest, problem)
+		return
+	}
+	if len(req.Data) > p.cfg.MaxDataBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "Push data too large")
+		return
+	}
+
+	log := slog.With("component", "push")
+	ctx := r.Context()
+	recipients, err := p.recipients(ctx, req)
+	if errors.Is(err, ErrRoomNotFound) {
+		writeError(w, http.StatusNotFound, "Topic does not exist")
+		return
+	}
+	if err != nil {
+		log.Error("Failed to resolve push recipients", "error", err)
+		writeError(w, http.StatusBadGateway, "Failed to resolve recipients")
+		return
+	}
+
+	frame := PushFrame{
+		Type:   "push",
+		ID:     uuid.NewString(),
+		Topic:  req.Topic,
+		Data:   req.Data,
+		SentAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	result, err := p.deliver(ctx, frame, recipients, req.Queue)
+	if err != nil {
+		log.Error("Failed to deliver push", "push_id", frame.ID, "error", err)
+		writeError(w, http.StatusBadGateway, "Failed to deliver push")
+		return
+	}
+	log.Info("Delivered push", "push_id", frame.ID, "online", len(result.Online), "queued", result.Queued)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// validatePush reports what is wrong with a push, or "" when it is valid.
+func validatePush(req PushRequest) string {
+	targets := 0
+	for _, set := range []bool{req.User != "", req.Users != nil, req.Topic != "", req.Everyone} {
+		if set {
+			targets++
+		}
+	}
+	switch {
+	case targets != 1:
+		return "Exactly one of user, users, topic and everyone is required"
+	case req.Everyone && req.Queue:
+		return "queue cannot be combined with everyone"
+	case len(req.Data) == 0 || string(req.Data) == "null":
+		return "data is required"
+	case req.Topic != "" && !roomIDPattern.MatchString(req.Topic):
+		return "topic is invalid"
+	case len(req.Users) > MaxPushUsers:
+		return "users lists too many users"
+	}
+	if req.User != "" {
+		req.Users = []string{req.User}
+	}
+	for _, userID := range req.Users {
+		if userID == "" || len(userID) > maxUserIDLength {
+			return "users contains an invalid user ID"
+		}
+	}
+	return ""
+}
+
+// pushRecipients are the users a push is for, split by whether they are
+// online. A push to everyone is broadcast once rather than sent user by
+// user; online then only reports who it reached.
+type pushRecipients struct {
+	online   []string
+	offline  []string
+	everyone bool
+}
+
+func (p *PushAPI) recipients(ctx context.Context, req PushRequest) (pushRecipients, error) {
+	var users []string
+	switch {
+	case req.Everyone:
+		online, err := p.store.GetOnlineUsers(ctx)
+		return pushRecipients{online: online, everyone: true}, err
+	case req.Topic != "":
+		if _, err := p.store.GetRoom(ctx, req.Topic); err != nil {
+			return pushRecipients{}, err
+		}
+		members, err := p.store.RoomMembers(ctx, req.Topic)
+		if err != nil {
+			return pushRecipients{}, err
+		}
+		users = members
+	case req.User != "":
+		users = []string{req.User}
+	default:
+		users = uniqueUsers(req.Users)
+	}
+
+	online, err := p.store.OnlineUsers(ctx, users)
+	if err != nil {
+		return pushRecipients{}, err
+	}
+	r := pushRecipients{online: []string{}, offline: []string{}}
+	for i, userID := range users {
+		if online[i] {
+			r.online = append(r.online, userID)
+		} else {
+			r.offline = append(r.offline, userID)
+		}
+	}
+	return r, nil
+}
+
+func (p *PushAPI) deliver(ctx context.Context, frame PushFrame, r pushRecipients, queue bool) (PushResult, error) {
+	ctx = sdk.WithRequestID(ctx, frame.ID)
+	if r.everyone {
+		if err := p.service.Broadcast(ctx, frame); err != nil {
+			return PushResult{}, err
+		}
+	} else {
+		for _, userID := range r.online {
+			if err := p.service.SendToUser(ctx, userID, frame); err != nil {
+				return PushResult{}, err
+			}
+		}
+	}
+	result := PushResult{ID: frame.ID, Online: r.online, Offline: r.offline}
+	if result.Online == nil {
+		result.Online = []string{}
+	}
+	if queue && len(r.offline) > 0 {
+		encoded, err := json.Marshal(frame)
+		if err != nil {
+			return PushResult{}, err
+		}
+		if err := p.store.QueuePush(ctx, r.offline, encoded); err != nil {
+			return PushResult{}, err
+		}
+		result.Queued = len(r.offline)
+	}
+	return result, nil
+}
+
+func uniqueUsers(users []string) []string {
+	seen := make(map[string]bool, len(users))
+	unique := users[:0:0]
+	for _, userID := range users {
+		if !seen[userID] {
+			seen[userID] = true
+			unique = append(unique, userID)
+		}
+	}
+	return unique
+}
+
+// deliverQueuedPushes hands the user connecting in c the pushes queued
+// while they were offline.
+func deliverQueuedPushes(c *sdk.Context, store *Store) {
+	log := c.Logger()
+	frames, err := store.TakeQueuedPushes(c, c.ClientID())
+	if err != nil {
+		log.Error("Failed to take queued pushes", "error", err)
+		return
+	}
+	for _, encoded := range frames {
+		var frame PushFrame
+		if err := json.Unmarshal([]byte(encoded), &frame); err != nil {
+			log.Warn("Dropped unreadable queued push", "error", err)
+			continue
+		}
+		if err := c.Service().SendToUser(sdk.WithRequestID(c, frame.ID), c.ClientID(), frame); err != nil {
+			log.Error("Failed to deliver queued push", "push_id", frame.ID, "error", err)
+		}
+	}
+	if len(frames) > 0 {
+		log.Debug("Delivered queued pushes", "count", len(frames))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
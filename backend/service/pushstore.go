@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// pushQueueKeyPrefix prefixes the per-user list of pushes waiting for the
+// user to connect, oldest first.
+const pushQueueKeyPrefix = "push:queue:"
+
+// DefaultPushQueueLimit and DefaultPushQueueTTL bound the pushes queued for
+// an offline user unless WithPushQueue says otherwise.
+const (
+	DefaultPushQueueLimit = 100
+	DefaultPushQueueTTL   = 72 * time.Hour
+)
+
+// WithPushQueue caps the pushes queued per offline user. The oldest are
+// dropped beyond limit, and a queue nobody adds to expires after ttl.
+func WithPushQueue(limit int, ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		if limit > 0 {
+			s.pushQueueLimit = int64(limit)
+		}
+		if ttl > 0 {
+			s.pushQueueTTL = ttl
+		}
+	}
+}
+
+// OnlineUsers reports, in order, which of userIDs are online.
+func (s *Store) OnlineUsers(ctx context.Context, userIDs []string) (online []bool, err error) {
+	ctx, span := startSpan(ctx, "online_users")
+	defer func() { endSpan(span, err) }()
+
+	cmds := make([]*redis.BoolCmd, len(userIDs))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			cmds[i] = pipe.SIsMember(ctx, onlineUsersSetKey, userID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	online = make([]bool, len(userIDs))
+	for i, cmd := range cmds {
+		online[i] = cmd.Val()
+	}
+	return online, nil
+}
+
+// QueuePush queues an encoded push for each of userIDs.
+func (s *Store) QueuePush(ctx context.Context, userIDs []string, frame []byte) (err error) {
+	ctx, span := startSpan(ctx, "queue_push")
+	defer func() { endSpan(span, err) }()
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range userIDs {
+			key := pushQueueKeyPrefix + userID
+			pipe.RPush(ctx, key, frame)
+			pipe.LTrim(ctx, key, -s.pushQueueLimit, -1)
+			pipe.Expire(ctx, key, s.pushQueueTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// TakeQueuedPushes removes and returns the pushes queued for userID,
+// oldest first. Concurrent callers never receive the same push.
+func (s *Store) TakeQueuedPushes(ctx context.Context, userID string) (frames []string, err error) {
+	ctx, span := startSpan(ctx, "take_queued_pushes")
+	defer func() { endSpan(span, err) }()
+
+	key := pushQueueKeyPrefix + userID
+	var queued *redis.StringSliceCmd
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		queued = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queued.Val(), nil
+}
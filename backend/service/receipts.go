@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+const ErrorCodeMessageNotFound = "message_not_found"
+
+// messageIDPattern matches the stream IDs that identify stored messages.
+var messageIDPattern = regexp.MustCompile(`^[0-9]{1,20}-[0-9]{1,20}$`)
+
+// ReceiptRequest is an ack, read or get_cursors frame. Exactly one of
+// RoomID and With names the conversation; With is the other participant of
+// a direct conversation.
+type ReceiptRequest struct {
+	ID     string `json:"id"`
+	RoomID string `json:"room_id,omitempty"`
+	With   string `json:"with,omitempty"`
+}
+
+// MessageStatus tells participants that By has received (delivered) or
+// read every message of the conversation up to ID.
+type MessageStatus struct {
+	Type   string    `json:"type"`
+	ID     string    `json:"id"`
+	RoomID string    `json:"room_id,omitempty"`
+	With   string    `json:"with,omitempty"`
+	Status string    `json:"status"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+// Cursors answers get_cursors with every participant's delivered and read
+// cursors.
+type Cursors struct {
+	Type      string            `json:"type"`
+	RoomID    string            `json:"room_id,omitempty"`
+	With      string            `json:"with,omitempty"`
+	Delivered map[string]string `json:"delivered"`
+	Read      map[string]string `json:"read"`
+}
+
+// receiptRequestTypes are the request types handled by
+// handleReceiptRequest.
+var receiptRequestTypes = []string{"ack", "read", "get_cursors"}
+
+func handleReceiptRequest(c *sdk.Context, store *Store, req ReceiptRequest) error {
+	conv, err := receiptConversation(c, store, c.ClientID(), req)
+	if err == nil {
+		switch c.Type() {
+		case "ack":
+			err = acknowledge(c, store, conv, req)
+		case "read":
+			err = markRead(c, store, conv, req)
+		case "get_cursors":
+			err = cursors(c, store, conv, req)
+		}
+	}
+
+	var invalid invalidRequestError
+	switch {
+	case errors.As(err, &invalid):
+		return &sdk.Error{Code: ErrorCodeInvalidRequest, Message: string(invalid)}
+	case errors.Is(err, ErrMessageNotFound):
+		return sdk.Errorf(ErrorCodeMessageNotFound, "Message does not exist in this conversation")
+	}
+	return roomError(err)
+}
+
+// invalidRequestError describes a malformed request to the client.
+type invalidRequestError string
+
+func (e invalidRequestError) Error() string { return string(e) }
+
+// receiptConversation resolves the conversation a receipt refers to and
+// checks that the client takes part in it.
+func receiptConversation(ctx context.Context, store *Store, userID string, req ReceiptRequest) (Conversation, error) {
+	switch {
+	case (req.RoomID == "") == (req.With == ""):
+		return Conversation{}, invalidRequestError("Exactly one of room_id and with is required")
+	case req.RoomID != "":
+		if !roomIDPattern.MatchString(req.RoomID) {
+			return Conversation{}, invalidRequestError("room_id is invalid")
+		}
+		if err := requireMember(ctx, store, req.RoomID, userID); err != nil {
+			return Conversation{}, err
+		}
+		return RoomConversation(req.RoomID), nil
+	case req.With == userID || len(req.With) > maxUserIDLength:
+		return Conversation{}, invalidRequestError("with is invalid")
+	}
+	return DirectConversation(userID, req.With), nil
+}
+
+// acknowledge records that a message reached one of the client's
+// connections and tells its author. Acks of older messages, for example
+// from a second device, are absorbed by the delivered cursor.
+func acknowledge(c *sdk.Context, store *Store, conv Conversation, req ReceiptRequest) error {
+	message, err := lookupMessage(c, store, conv, req.ID)
+	if err != nil {
+		return err
+	}
+	if message.From == c.ClientID() {
+		return nil
+	}
+	advanced, err := store.AdvanceCursor(c, CursorDelivered, conv, c.ClientID(), req.ID)
+	if err != nil || !advanced {
+		return err
+	}
+	return c.SendToUser(message.From, newMessageStatus(CursorDelivered, conv, req.ID, c.ClientID()))
+}
+
+// markRead moves the client's read cursor, which also counts as delivery,
+// and tells the other participants.
+func markRead(c *sdk.Context, store *Store, conv Conversation, req ReceiptRequest) error {
+	if _, err := lookupMessage(c, store, conv, req.ID); err != nil {
+		return err
+	}
+	if _, err := store.AdvanceCursor(c, CursorDelivered, conv, c.ClientID(), req.ID); err != nil {
+		return err
+	}
+	advanced, err := store.AdvanceCursor(c, CursorRead, conv, c.ClientID(), req.ID)
+	if err != nil || !advanced {
+		return err
+	}
+
+	status := newMessageStatus(CursorRead, conv, req.ID, c.ClientID())
+	if conv.RoomID != "" {
+		return fanOutToRoom(c, store, conv.RoomID, c.ClientID(), status)
+	}
+	return c.SendToUser(req.With, status)
+}
+
+func cursors(c *sdk.Context, store *Store, conv Conversation, req ReceiptRequest) error {
+	delivered, err := store.Cursors(c, CursorDelivered, conv)
+	if err != nil {
+		return err
+	}
+	read, err := store.Cursors(c, CursorRead, conv)
+	if err != nil {
+		return err
+	}
+	return c.Reply(Cursors{
+		Type:      "cursors",
+		RoomID:    req.RoomID,
+		With:      req.With,
+		Delivered: delivered,
+		Read:      read,
+	})
+}
+
+func lookupMessage(ctx context.Context, store *Store, conv Conversation, id string) (RoomMessage, error) {
+	if !messageIDPattern.MatchString(id) {
+		return RoomMessage{}, invalidRequestError("id is missing or invalid")
+	}
+	return store.ConversationMessage(ctx, conv, id)
+}
+
+// newMessageStatus builds the status by sends. In a direct conversation the
+// recipient sees by as the other participant.
+func newMessageStatus(status string, conv Conversation, id, by string) MessageStatus {
+	s := MessageStatus{
+		Type:   "message_status",
+		ID:     id,
+		RoomID: conv.RoomID,
+		Status: status,
+		By:     by,
+		At:     time.Now().UTC(),
+	}
+	if conv.RoomID == "" {
+		s.With = by
+	}
+	return s
+}
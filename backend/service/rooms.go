@@ -0,0 +1,301 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+const (
+	maxRoomNameLength = 100
+	// DefaultHistoryPage and MaxHistoryPage bound get_history's limit.
+	DefaultHistoryPage = 50
+	MaxHistoryPage     = 200
+)
+
+const (
+	ErrorCodeRoomNotFound = "room_not_found"
+	ErrorCodeRoomExists   = "room_exists"
+	ErrorCodeNotMember    = "not_a_member"
+)
+
+// roomIDPattern keeps room IDs out of the ':' separated key space.
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+// RoomRequest is the payload of every room request; each type reads the
+// fields it needs.
+type RoomRequest struct {
+	Type        string          `json:"type"`
+	RoomID      string          `json:"room_id"`
+	Name        string          `json:"name"`
+	Mine        bool            `json:"mine"`
+	Body        json.RawMessage `json:"body"`
+	ClientMsgID string          `json:"client_msg_id,omitempty"`
+	Before      string          `json:"before"`
+	Limit       int             `json:"limit"`
+}
+
+// RoomEvent tells the online members of a room that someone joined or left.
+type RoomEvent struct {
+	Type   string `json:"type"`
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+}
+
+// RoomMessageFrame is a room message as written to members.
+type RoomMessageFrame struct {
+	Type string `json:"type"`
+	RoomMessage
+}
+
+// RoomMessageAck confirms to the sender that a message was stored.
+type RoomMessageAck struct {
+	Type        string    `json:"type"`
+	ID          string    `json:"id"`
+	RoomID      string    `json:"room_id"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+// RoomHistory is one page of a room's history, oldest first. NextCursor is
+// passed as before to fetch the preceding page and is empty on the last one.
+type RoomHistory struct {
+	Type       string        `json:"type"`
+	RoomID     string        `json:"room_id"`
+	Messages   []RoomMessage `json:"messages"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// roomRequestTypes are the request types handled by handleRoomRequest.
+var roomRequestTypes = []string{
+	"create_room", "join_room", "leave_room", "list_rooms",
+	"get_room_members", "send_room_message", "get_history",
+}
+
+func handleRoomRequest(c *sdk.Context, store *Store, req RoomRequest) error {
+	req.Type = c.Type()
+	if req.Type != "list_rooms" && req.Type != "create_room" && !roomIDPattern.MatchString(req.RoomID) {
+		return sdk.Errorf(ErrorCodeInvalidRequest, "room_id is missing or invalid")
+	}
+
+	var err error
+	switch req.Type {
+	case "create_room":
+		err = createRoom(c, store, req)
+	case "join_room":
+		err = joinRoom(c, store, req)
+	case "leave_room":
+		err = leaveRoom(c, store, req)
+	case "list_rooms":
+		err = listRooms(c, store, req)
+	case "get_room_members":
+		err = roomMembers(c, store, req)
+	case "send_room_message":
+		err = sendRoomMessage(c, store, req)
+	case "get_history":
+		err = roomHistory(c, store, req)
+	}
+	return roomError(err)
+}
+
+// roomError maps store errors to the errors sent to clients. Anything
+// unexpected is reported as internal.
+func roomError(err error) error {
+	var reply *sdk.Error
+	switch {
+	case err == nil || errors.As(err, &reply):
+		return err
+	case errors.Is(err, ErrRoomNotFound):
+		return sdk.Errorf(ErrorCodeRoomNotFound, "Room does not exist")
+	case errors.Is(err, ErrRoomExists):
+		return sdk.Errorf(ErrorCodeRoomExists, "Room already exists")
+	case errors.Is(err, ErrNotMember):
+		return sdk.Errorf(ErrorCodeNotMember, "You are not a member of this room")
+	}
+	return sdk.Internal(err, "Room request failed")
+}
+
+func createRoom(c *sdk.Context, store *Store, req RoomRequest) error {
+	if req.RoomID == "" {
+		req.RoomID = uuid.NewString()
+	}
+	if !roomIDPattern.MatchString(req.RoomID) {
+		return sdk.Errorf(ErrorCodeInvalidRequest, "room_id is invalid")
+	}
+	if req.Name == "" {
+		req.Name = req.RoomID
+	}
+	if len(req.Name) > maxRoomNameLength {
+		return sdk.Errorf(ErrorCodeInvalidRequest, "Room name is too long")
+	}
+
+	room := Room{
+		ID:        req.RoomID,
+		Name:      req.Name,
+		CreatedBy: c.ClientID(),
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+		Members:   1,
+	}
+	if err := store.CreateRoom(c, room); err != nil {
+		return err
+	}
+	return c.Reply(map[string]interface{}{"type": "room_created", "room": room})
+}
+
+func joinRoom(c *sdk.Context, store *Store, req RoomRequest) error {
+	joined, err := store.JoinRoom(c, req.RoomID, c.ClientID())
+	if err != nil {
+		return err
+	}
+	room, err := store.GetRoom(c, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if err := c.Reply(map[string]interface{}{"type": "room_joined", "room": room}); err != nil {
+		return err
+	}
+	if joined {
+		return fanOutToRoom(c, store, req.RoomID, c.ClientID(),
+			RoomEvent{Type: "room_member_joined", RoomID: req.RoomID, UserID: c.ClientID()})
+	}
+	return nil
+}
+
+func leaveRoom(c *sdk.Context, store *Store, req RoomRequest) error {
+	if err := store.LeaveRoom(c, req.RoomID, c.ClientID()); err != nil {
+		return err
+	}
+	if err := c.Reply(map[string]interface{}{"type": "room_left", "room_id": req.RoomID}); err != nil {
+		return err
+	}
+	return fanOutToRoom(c, store, req.RoomID, "",
+		RoomEvent{Type: "room_member_left", RoomID: req.RoomID, UserID: c.ClientID()})
+}
+
+func listRooms(c *sdk.Context, store *Store, req RoomRequest) error {
+	userID := ""
+	if req.Mine {
+		userID = c.ClientID()
+	}
+	rooms, err := store.ListRooms(c, userID)
+	if err != nil {
+		return err
+	}
+	return c.Reply(map[string]interface{}{"type": "room_list", "rooms": rooms})
+}
+
+func roomMembers(c *sdk.Context, store *Store, req RoomRequest) error {
+	if err := requireMember(c, store, req.RoomID, c.ClientID()); err != nil {
+		return err
+	}
+	members, err := store.RoomMembers(c, req.RoomID)
+	if err != nil {
+		return err
+	}
+	online, err := store.OnlineRoomMembers(c, req.RoomID)
+	if err != nil {
+		return err
+	}
+	return c.Reply(map[string]interface{}{
+		"type":    "room_members",
+		"room_id": req.RoomID,
+		"members": members,
+		"online":  online,
+	})
+}
+
+func sendRoomMessage(c *sdk.Context, store *Store, req RoomRequest) error {
+	if len(req.Body) == 0 || string(req.Body) == "null" {
+		return sdk.Errorf(ErrorCodeInvalidRequest, "Message body is required")
+	}
+	if err := requireMember(c, store, req.RoomID, c.ClientID()); err != nil {
+		return err
+	}
+
+	rm := RoomMessage{
+		RoomID: req.RoomID,
+		From:   c.ClientID(),
+		Body:   req.Body,
+		SentAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := store.AppendRoomMessage(c, &rm); err != nil {
+		return err
+	}
+	if err := c.Reply(RoomMessageAck{
+		Type:        "room_message_ack",
+		ID:          rm.ID,
+		RoomID:      rm.RoomID,
+		ClientMsgID: req.ClientMsgID,
+		SentAt:      rm.SentAt,
+	}); err != nil {
+		return err
+	}
+	// The sender is included so that their other connections see the
+	// message too.
+	return fanOutToRoom(c, store, req.RoomID, "",
+		RoomMessageFrame{Type: "room_message", RoomMessage: rm})
+}
+
+func roomHistory(c *sdk.Context, store *Store, req RoomRequest) error {
+	if err := requireMember(c, store, req.RoomID, c.ClientID()); err != nil {
+		return err
+	}
+	if req.Before != "" && !messageIDPattern.MatchString(req.Before) {
+		return sdk.Errorf(ErrorCodeInvalidRequest, "before is invalid")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryPage
+	}
+	limit = min(limit, MaxHistoryPage)
+
+	messages, more, err := store.RoomHistory(c, req.RoomID, req.Before, limit)
+	if err != nil {
+		return err
+	}
+	page := RoomHistory{Type: "room_history", RoomID: req.RoomID, Messages: messages}
+	if more {
+		page.NextCursor = messages[0].ID
+	}
+	return c.Reply(page)
+}
+
+// requireMember returns ErrRoomNotFound or ErrNotMember unless userID is a
+// member of the room.
+func requireMember(ctx context.Context, store *Store, roomID, userID string) error {
+	member, err := store.IsRoomMember(ctx, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if member {
+		return nil
+	}
+	if _, err := store.GetRoom(ctx, roomID); err != nil {
+		return err
+	}
+	return ErrNotMember
+}
+
+// fanOutToRoom sends data to every online member of the room except skip.
+// Offline members catch up with get_history.
+func fanOutToRoom(c *sdk.Context, store *Store, roomID, skip string, data interface{}) error {
+	members, err := store.OnlineRoomMembers(c, roomID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member == skip {
+			continue
+		}
+		if err := c.SendToUser(member, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// roomsSetKey holds the ID of every room.
+	roomsSetKey = "rooms"
+	// roomKeyPrefix prefixes the hash holding a room's name and creator.
+	roomKeyPrefix         = "room:"
+	roomMembersKeyPrefix  = "room:members:"
+	roomMessagesKeyPrefix = "room:messages:"
+	// userRoomsKeyPrefix prefixes the set of rooms a user has joined.
+	userRoomsKeyPrefix = "user:rooms:"
+)
+
+var (
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound = errors.New("room not found")
+	ErrNotMember    = errors.New("not a member of the room")
+)
+
+// Room is a named group of users. Members is only filled in by reads.
+type Room struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Members   int64     `json:"members"`
+}
+
+// RoomMessage is one entry of a room's history. ID is the Redis stream ID,
+// which orders messages and doubles as the history cursor.
+type RoomMessage struct {
+	ID     string          `json:"id"`
+	RoomID string          `json:"room_id"`
+	From   string          `json:"from"`
+	Body   json.RawMessage `json:"body"`
+	SentAt time.Time       `json:"sent_at"`
+}
+
+// createRoomScript creates the room and makes its creator the first member.
+var createRoomScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'name', ARGV[2], 'created_by', ARGV[3], 'created_at', ARGV[4])
+redis.call('SADD', KEYS[2], ARGV[1])
+redis.call('SADD', KEYS[3], ARGV[3])
+redis.call('SADD', KEYS[4], ARGV[1])
+return 1
+`)
+
+// joinRoomScript adds a member to an existing room. It returns -1 when the
+// room does not exist and otherwise whether the user was newly added.
+var joinRoomScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+redis.call('SADD', KEYS[3], ARGV[1])
+return redis.call('SADD', KEYS[2], ARGV[2])
+`)
+
+func roomKeys(roomID string) (room, members, messages string) {
+	return roomKeyPrefix + roomID, roomMembersKeyPrefix + roomID, roomMessagesKeyPrefix + roomID
+}
+
+func (s *Store) CreateRoom(ctx context.Context, room Room) (err error) {
+	ctx, span := startSpan(ctx, "create_room")
+	defer func() { endSpan(span, err) }()
+
+	roomKey, membersKey, _ := roomKeys(room.ID)
+	keys := []string{roomKey, roomsSetKey, membersKey, userRoomsKeyPrefix + room.CreatedBy}
+	created, err := createRoomScript.Run(ctx, s.rdb, keys,
+		room.ID, room.Name, room.CreatedBy, room.CreatedAt.UnixMilli()).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return ErrRoomExists
+	}
+	return nil
+}
+
+// JoinRoom adds userID to the room and reports whether they were not a
+// member already.
+func (s *Store) JoinRoom(ctx context.Context, roomID, userID string) (joined bool, err error) {
+	ctx, span := startSpan(ctx, "join_room")
+	defer func() { endSpan(span, err) }()
+
+	roomKey, membersKey, _ := roomKeys(roomID)
+	keys := []string{roomKey, membersKey, userRoomsKeyPrefix + userID}
+	added, err := joinRoomScript.Run(ctx, s.rdb, keys, roomID, userID).Int()
+	if err != nil {
+		return false, err
+	}
+	if added < 0 {
+		return false, ErrRoomNotFound
+	}
+	return added == 1, nil
+}
+
+func (s *Store) LeaveRoom(ctx context.Context, roomID, userID string) (err error) {
+	ctx, span := startSpan(ctx, "leave_room")
+	defer func() { endSpan(span, err) }()
+
+	_, membersKey, _ := roomKeys(roomID)
+	var removed *redis.IntCmd
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.SRem(ctx, membersKey, userID)
+		pipe.SRem(ctx, userRoomsKeyPrefix+userID, roomID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed.Val() == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (s *Store) GetRoom(ctx context.Context, roomID string) (room Room, err error) {
+	ctx, span := startSpan(ctx, "get_room")
+	defer func() { endSpan(span, err) }()
+
+	rooms, err := s.getRooms(ctx, []string{roomID})
+	if err != nil {
+		return Room{}, err
+	}
+	if len(rooms) == 0 {
+		return Room{}, ErrRoomNotFound
+	}
+	return rooms[0], nil
+}
+
+// ListRooms returns every room, or only the rooms userID has joined when
+// it is not empty, ordered by ID.
+func (s *Store) ListRooms(ctx context.Context, userID string) (rooms []Room, err error) {
+	ctx, span := startSpan(ctx, "list_rooms")
+	defer func() { endSpan(span, err) }()
+
+	key := roomsSetKey
+	if userID != "" {
+		key = userRoomsKeyPrefix + userID
+	}
+	ids, err := s.rdb.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	return s.getRooms(ctx, ids)
+}
+
+// getRooms loads rooms in the order of ids, skipping any that no longer
+// exist.
+func (s *Store) getRooms(ctx context.Context, ids []string) ([]Room, error) {
+	if len(ids) == 0 {
+		return []Room{}, nil
+	}
+	fields := make([]*redis.StringStringMapCmd, len(ids))
+	counts := make([]*redis.IntCmd, len(ids))
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			roomKey, membersKey, _ := roomKeys(id)
+			fields[i] = pipe.HGetAll(ctx, roomKey)
+			counts[i] = pipe.SCard(ctx, membersKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]Room, 0, len(ids))
+	for i, id := range ids {
+		f := fields[i].Val()
+		if len(f) == 0 {
+			continue
+		}
+		createdAt, _ := strconv.ParseInt(f["created_at"], 10, 64)
+		rooms = append(rooms, Room{
+			ID:        id,
+			Name:      f["name"],
+			CreatedBy: f["created_by"],
+			CreatedAt: time.UnixMilli(createdAt).UTC(),
+			Members:   counts[i].Val(),
+		})
+	}
+	return rooms, nil
+}
+
+func (s *Store) RoomMembers(ctx context.Context, roomID string) (members []string, err error) {
+	ctx, span := startSpan(ctx, "room_members")
+	defer func() { endSpan(span, err) }()
+
+	_, membersKey, _ := roomKeys(roomID)
+	if members, err = s.rdb.SMembers(ctx, membersKey).Result(); err != nil {
+		return nil, err
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+// OnlineRoomMembers returns the members of the room that are connected to
+// some pooler.
+func (s *Store) OnlineRoomMembers(ctx context.Context, roomID string) (members []string, err error) {
+	ctx, span := startSpan(ctx, "online_room_members")
+	defer func() { endSpan(span, err) }()
+
+	_, membersKey, _ := roomKeys(roomID)
+	if members, err = s.rdb.SInter(ctx, membersKey, onlineUsersSetKey).Result(); err != nil {
+		return nil, err
+	}
+	slices.Sort(members)
+	return members, nil
+}
+
+func (s *Store) IsRoomMember(ctx context.Context, roomID, userID string) (member bool, err error) {
+	ctx, span := startSpan(ctx, "is_room_member")
+	defer func() { endSpan(span, err) }()
+
+	_, membersKey, _ := roomKeys(roomID)
+	return s.rdb.SIsMember(ctx, membersKey, userID).Result()
+}
+
+// AppendRoomMessage adds msg to the room's history and sets its ID. The
+// history is trimmed to roughly the configured limit.
+func (s *Store) AppendRoomMessage(ctx context.Context, msg *RoomMessage) (err error) {
+	ctx, span := startSpan(ctx, "append_room_message")
+	defer func() { endSpan(span, err) }()
+
+	_, _, messagesKey := roomKeys(msg.RoomID)
+	msg.ID, err = s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: messagesKey,
+		MaxLen: s.roomHistoryLimit,
+		Approx: true,
+		Values: map[string]interface{}{
+			"from":    msg.From,
+			"body":    string(msg.Body),
+			"sent_at": msg.SentAt.UnixMilli(),
+		},
+	}).Result()
+	return err
+}
+
+// RoomHistory returns up to limit messages older than the before cursor,
+// or the latest messages when before is empty, oldest first. more reports
+// whether older messages remain.
+func (s *Store) RoomHistory(ctx context.Context, roomID, before string, limit int) (messages []RoomMessage, more bool, err error) {
+	ctx, span := startSpan(ctx, "room_history")
+	defer func() { endSpan(span, err) }()
+
+	_, _, messagesKey := roomKeys(roomID)
+	start := "+"
+	if before != "" {
+		start = "(" + before
+	}
+	entries, err := s.rdb.XRevRangeN(ctx, messagesKey, start, "-", int64(limit)+1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(entries) > limit {
+		entries, more = entries[:limit], true
+	}
+
+	messages = make([]RoomMessage, len(entries))
+	for i, entry := range entries {
+		messages[len(entries)-1-i] = decodeMessage(entry, roomID)
+	}
+	return messages, more, nil
+}
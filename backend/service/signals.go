@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+)
+
+// SignalEventsChannel carries ephemeral signals such as typing indicators.
+// Poolers have already rate limited and coalesced them.
+const SignalEventsChannel = "ephemeral-events"
+
+// Signal is an ephemeral event for a room or a direct conversation.
+type Signal struct {
+	Kind   string      `json:"kind"`
+	RoomID string      `json:"room_id,omitempty"`
+	To     string      `json:"to,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Clear  bool        `json:"clear,omitempty"`
+	TTLMs  int64       `json:"ttl_ms,omitempty"`
+}
+
+// SignalFrame is a signal as written to its recipients. From is the
+// authenticated sender.
+type SignalFrame struct {
+	Type   string      `json:"type"`
+	Kind   string      `json:"kind"`
+	From   string      `json:"from"`
+	RoomID string      `json:"room_id,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Clear  bool        `json:"clear,omitempty"`
+	TTLMs  int64       `json:"ttl_ms,omitempty"`
+}
+
+// relaySignal relays an ephemeral signal to the other members of a room or
+// the other side of a direct conversation. A direct signal is only relayed
+// to a user who shares a room or a direct conversation with the sender.
+// Signals are never stored; a signal that cannot be relayed is dropped.
+func relaySignal(c *sdk.Context, store *Store) error {
+	log := c.Logger()
+
+	var sig Signal
+	if err := json.Unmarshal(c.Data(), &sig); err != nil || sig.Kind == "" {
+		log.Debug("Dropped malformed signal")
+		return nil
+	}
+	frame := SignalFrame{
+		Type:   "ephemeral",
+		Kind:   sig.Kind,
+		From:   c.ClientID(),
+		RoomID: sig.RoomID,
+		Data:   sig.Data,
+		Clear:  sig.Clear,
+		TTLMs:  sig.TTLMs,
+	}
+
+	switch {
+	case sig.RoomID != "":
+		member, err := store.IsRoomMember(c, sig.RoomID, c.ClientID())
+		if err != nil || !member {
+			log.Debug("Dropped signal from non-member", "room_id", sig.RoomID, "error", err)
+			return nil
+		}
+		if err := fanOutToRoom(c, store, sig.RoomID, c.ClientID(), frame); err != nil {
+			log.Warn("Failed to relay signal", "room_id", sig.RoomID, "error", err)
+		}
+	case sig.To != "" && sig.To != c.ClientID():
+		shared, err := store.SharesConversation(c, c.ClientID(), sig.To)
+		if err != nil || !shared {
+			log.Debug("Dropped signal to a user without a shared conversation", "to", sig.To, "error", err)
+			return nil
+		}
+		if err := c.SendToUser(sig.To, frame); err != nil {
+			log.Warn("Failed to relay signal", "to", sig.To, "error", err)
+		}
+	}
+	return nil
+}
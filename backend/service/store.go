@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wailbentafat/ws-hub/backend/tracing"
+)
+
+const (
+	onlineUsersSetKey = "online_users"
+	// userConnsKeyPrefix prefixes the per-user set of open connection IDs,
+	// which keeps a user online until their last connection closes.
+	userConnsKeyPrefix = "presence:conns:"
+)
+
+// removeConnScript drops one connection of a user, records when the user
+// was last seen and takes the user out of the online set once no
+// connection is left.
+var removeConnScript = redis.NewScript(`
+redis.call('SREM', KEYS[1], ARGV[2])
+redis.call('SREM', KEYS[3], ARGV[2])
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[3])
+if redis.call('SCARD', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// DefaultRoomHistoryLimit is how many messages a room keeps unless
+// WithRoomHistoryLimit says otherwise.
+const DefaultRoomHistoryLimit = 1000
+
+type Store struct {
+	rdb              *redis.Client
+	roomHistoryLimit int64
+	pushQueueLimit   int64
+	pushQueueTTL     time.Duration
+}
+
+// StoreOption configures a Store.
+type StoreOption func(*Store)
+
+// WithRoomHistoryLimit caps the number of messages kept per room. Older
+// messages are trimmed as new ones arrive.
+func WithRoomHistoryLimit(n int) StoreOption {
+	return func(s *Store) {
+		if n > 0 {
+			s.roomHistoryLimit = int64(n)
+		}
+	}
+}
+
+func NewStore(rdb *redis.Client, opts ...StoreOption) *Store {
+	s := &Store{
+		rdb:              rdb,
+		roomHistoryLimit: DefaultRoomHistoryLimit,
+		pushQueueLimit:   DefaultPushQueueLimit,
+		pushQueueTTL:     DefaultPushQueueTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// startSpan opens a client span for a single store operation.
+func startSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "store."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis")),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *Store) AddOnlineUser(ctx context.Context, userID, connID string) (err error) {
+	ctx, span := startSpan(ctx, "add_online_user")
+	defer func() { endSpan(span, err) }()
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if connID != "" {
+			pipe.SAdd(ctx, userConnsKeyPrefix+userID, connID)
+		}
+		pipe.SAdd(ctx, onlineUsersSetKey, userID)
+		return nil
+	})
+	return err
+}
+
+// RemoveOnlineUser closes one connection of the user. Events without a
+// connection ID come from poolers that predate multi-connection support
+// and take the user offline outright.
+func (s *Store) RemoveOnlineUser(ctx context.Context, userID, connID string) (err error) {
+	ctx, span := startSpan(ctx, "remove_online_user")
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now().UnixMilli()
+	if connID == "" {
+		_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, userConnsKeyPrefix+userID, idleConnsKeyPrefix+userID)
+			pipe.SRem(ctx, onlineUsersSetKey, userID)
+			pipe.HSet(ctx, lastSeenKey, userID, now)
+			return nil
+		})
+		return err
+	}
+
+	keys := []string{userConnsKeyPrefix + userID, onlineUsersSetKey, idleConnsKeyPrefix + userID, lastSeenKey}
+	return removeConnScript.Run(ctx, s.rdb, keys, userID, connID, now).Err()
+}
+
+func (s *Store) GetOnlineUsers(ctx context.Context) (users []string, err error) {
+	ctx, span := startSpan(ctx, "get_online_users")
+	defer func() { endSpan(span, err) }()
+
+	return s.rdb.SMembers(ctx, onlineUsersSetKey).Result()
+}
+
+func (s *Store) IsOnline(ctx context.Context, userID string) (online bool, err error) {
+	ctx, span := startSpan(ctx, "is_online")
+	defer func() { endSpan(span, err) }()
+
+	return s.rdb.SIsMember(ctx, onlineUsersSetKey, userID).Result()
+}
@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is one failed delivery as recorded in the dead-letter log.
+type DeadLetter struct {
+	URL      string    `json:"url"`
+	Event    Event     `json:"event"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// deadLetterLog appends failed deliveries to a JSON lines file. Without a
+// path they are only logged.
+type deadLetterLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (l *deadLetterLog) append(dl delivery, cause error, attempts int) {
+	entry := DeadLetter{
+		URL:      dl.endpoint.URL,
+		Event:    dl.event,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if l.path == "" {
+		logger().Error("Dropped webhook delivery", "url", entry.URL, "event_id", entry.Event.ID, "error", entry.Error)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := appendDeadLetters(l.path, []DeadLetter{entry}); err != nil {
+		logger().Error("Failed to write dead letter", "path", l.path, "event_id", entry.Event.ID, "error", err)
+	}
+}
+
+func appendDeadLetters(path string, entries []DeadLetter) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// ReadDeadLetters reads every entry of a dead-letter log. A missing file
+// holds no entries.
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// ReplayResult counts the outcome of a replay.
+type ReplayResult struct {
+	Delivered int
+	Failed    int
+	// Skipped entries are for URLs that are no longer configured, so they
+	// cannot be signed. They stay in the log.
+	Skipped int
+}
+
+// Replay redelivers every entry of the dead-letter log at path to its
+// endpoint, signed with the endpoint's current secret. Entries that fail
+// again or are skipped are written back; delivered ones are removed. The
+// log should not be written to by a running dispatcher meanwhile.
+func Replay(ctx context.Context, path string, cfg Config) (ReplayResult, error) {
+	var result ReplayResult
+	entries, err := ReadDeadLetters(path)
+	if err != nil || len(entries) == 0 {
+		return result, err
+	}
+
+	endpoints := make(map[string]Endpoint, len(cfg.Endpoints))
+	for _, e := range cfg.Endpoints {
+		endpoints[e.URL] = e
+	}
+	cfg.setDefaults()
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	var remaining []DeadLetter
+	for _, entry := range entries {
+		endpoint, ok := endpoints[entry.URL]
+		if !ok {
+			result.Skipped++
+			remaining = append(remaining, entry)
+			continue
+		}
+		attempts, err := Deliver(ctx, client, endpoint, entry.Event, cfg)
+		if err != nil {
+			result.Failed++
+			entry.Error = err.Error()
+			entry.Attempts += attempts
+			entry.FailedAt = time.Now().UTC()
+			remaining = append(remaining, entry)
+			continue
+		}
+		result.Delivered++
+	}
+	return result, rewriteDeadLetters(path, remaining)
+}
+
+// rewriteDeadLetters replaces the log with entries, atomically.
+func rewriteDeadLetters(path string, entries []DeadLetter) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := appendDeadLetters(tmp, entries); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,325 @@
+// Package webhook delivers connection and message lifecycle events to
+// external HTTP endpoints. Payloads are signed with a per-endpoint secret,
+// failed deliveries are retried with exponential backoff, and deliveries
+// that still fail are appended to a dead-letter log for later replay.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/google/uuid"
+)
+
+// Event types besides message events, which are named MessageEvent(type).
+const (
+	EventUserConnected    = "user_connected"
+	EventUserDisconnected = "user_disconnected"
+)
+
+// Headers set on every delivery. The signature covers the timestamp and
+// the body; see Sign.
+const (
+	HeaderEvent     = "X-Wshub-Event"
+	HeaderDelivery  = "X-Wshub-Delivery"
+	HeaderTimestamp = "X-Wshub-Timestamp"
+	HeaderSignature = "X-Wshub-Signature"
+)
+
+// MessageEvent names the event sent for a client request of the given type.
+func MessageEvent(requestType string) string {
+	return "message." + requestType
+}
+
+// Event is the body of a delivery. ID stays the same across retries and
+// replays so that receivers can drop duplicates.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	UserID     string          `json:"user_id"`
+	ConnID     string          `json:"conn_id,omitempty"`
+	PoolerID   string          `json:"pooler_id,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// NewEvent stamps an event with a fresh ID and the current time.
+func NewEvent(eventType, userID, connID, poolerID string, data json.RawMessage) Event {
+	return Event{
+		ID:         uuid.NewString(),
+		Type:       eventType,
+		OccurredAt: time.Now().UTC(),
+		UserID:     userID,
+		ConnID:     connID,
+		PoolerID:   poolerID,
+		Data:       data,
+	}
+}
+
+// Endpoint is one webhook receiver and the events it subscribes to. An
+// event pattern is an event type, a prefix ending in ".*" such as
+// "message.*", or "*" for every event.
+type Endpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Wants reports whether the endpoint subscribes to eventType.
+func (e Endpoint) Wants(eventType string) bool {
+	for _, pattern := range e.Events {
+		if pattern == "*" || pattern == eventType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasSuffix(prefix, ".") && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type fileConfig struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// LoadEndpoints reads the endpoints from a JSON file of the form
+// {"endpoints": [{"url", "secret", "events"}]}.
+func LoadEndpoints(path string) ([]Endpoint, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, e := range cfg.Endpoints {
+		if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+			return nil, fmt.Errorf("endpoint %d: url must be http or https", i)
+		}
+		if e.Secret == "" {
+			return nil, fmt.Errorf("endpoint %d: secret is required", i)
+		}
+		if len(e.Events) == 0 {
+			return nil, fmt.Errorf("endpoint %d: events is required", i)
+		}
+	}
+	return cfg.Endpoints, nil
+}
+
+// Config configures a Dispatcher.
+type Config struct {
+	Endpoints []Endpoint
+	// Workers deliver events concurrently; QueueSize bounds the events
+	// waiting for a worker. Events that do not fit are dead-lettered.
+	Workers   int
+	QueueSize int
+	// Timeout bounds a single delivery attempt.
+	Timeout time.Duration
+	// RetryInitial is the first retry delay, which doubles on each attempt
+	// until RetryMaxElapsed has passed since the first one.
+	RetryInitial    time.Duration
+	RetryMaxElapsed time.Duration
+	// DeadLetterPath is the JSON lines file that failed deliveries are
+	// appended to.
+	DeadLetterPath string
+}
+
+func (c *Config) setDefaults() {
+	if c.Workers <= 0 {
+		c.Workers = 4
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.RetryInitial <= 0 {
+		c.RetryInitial = 500 * time.Millisecond
+	}
+	if c.RetryMaxElapsed <= 0 {
+		c.RetryMaxElapsed = 5 * time.Minute
+	}
+}
+
+func logger() *slog.Logger {
+	return slog.Default().With("component", "webhook")
+}
+
+// delivery is one event bound for one endpoint.
+type delivery struct {
+	endpoint Endpoint
+	event    Event
+}
+
+// Dispatcher queues events for the endpoints subscribed to them and
+// delivers them in the background. A nil Dispatcher drops every event.
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+	queue  chan delivery
+	dead   *deadLetterLog
+	wg     sync.WaitGroup
+}
+
+func NewDispatcher(cfg Config) *Dispatcher {
+	cfg.setDefaults()
+	return &Dispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan delivery, cfg.QueueSize),
+		dead:   &deadLetterLog{path: cfg.DeadLetterPath},
+	}
+}
+
+// Start runs the workers until ctx is done. Events still queued then are
+// dead-lettered so that they can be replayed.
+func (d *Dispatcher) Start(ctx context.Context) {
+	for range d.cfg.Workers {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.work(ctx)
+		}()
+	}
+}
+
+// Wait blocks until the workers started by Start have returned.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case dl := <-d.queue:
+					d.dead.append(dl, ctx.Err(), 0)
+				default:
+					return
+				}
+			}
+		case dl := <-d.queue:
+			attempts, err := Deliver(ctx, d.client, dl.endpoint, dl.event, d.cfg)
+			if err != nil {
+				logger().Warn("Webhook delivery failed", "url", dl.endpoint.URL, "event", dl.event.Type,
+					"event_id", dl.event.ID, "attempts", attempts, "error", err)
+				d.dead.append(dl, err, attempts)
+			}
+		}
+	}
+}
+
+// Wants reports whether any endpoint subscribes to eventType, so that
+// callers can skip building events nobody receives.
+func (d *Dispatcher) Wants(eventType string) bool {
+	if d == nil {
+		return false
+	}
+	for _, e := range d.cfg.Endpoints {
+		if e.Wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatch queues ev for every endpoint subscribed to it. It never blocks.
+func (d *Dispatcher) Dispatch(ev Event) {
+	if d == nil {
+		return
+	}
+	for _, e := range d.cfg.Endpoints {
+		if !e.Wants(ev.Type) {
+			continue
+		}
+		dl := delivery{endpoint: e, event: ev}
+		select {
+		case d.queue <- dl:
+		default:
+			logger().Warn("Webhook queue full, dead-lettering event", "url", e.URL, "event", ev.Type, "event_id", ev.ID)
+			d.dead.append(dl, errQueueFull, 0)
+		}
+	}
+}
+
+var errQueueFull = fmt.Errorf("webhook queue full")
+
+// Deliver posts ev to the endpoint, retrying with exponential backoff. It
+// returns the number of attempts made and the last error. Responses other
+// than 2xx are failures; 4xx responses other than 408 and 429 are not
+// retried.
+func Deliver(ctx context.Context, client *http.Client, endpoint Endpoint, ev Event, cfg Config) (attempts int, err error) {
+	cfg.setDefaults()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return 0, err
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = cfg.RetryInitial
+	b.MaxElapsedTime = cfg.RetryMaxElapsed
+	err = backoff.Retry(func() error {
+		attempts++
+		return post(ctx, client, endpoint, ev, body)
+	}, backoff.WithContext(b, ctx))
+	return attempts, err
+}
+
+func post(ctx context.Context, client *http.Client, endpoint Endpoint, ev Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, ev.Type)
+	req.Header.Set(HeaderDelivery, ev.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("endpoint answered %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return backoff.Permanent(err)
+	}
+	return err
+}
+
+// Sign returns the signature header value for a body sent at timestamp:
+// "sha256=" followed by the hex HMAC-SHA256 of "timestamp.body". Receivers
+// recompute it with the shared secret and compare in constant time.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+
+	"github.com/wailbentafat/ws-hub/admin"
+	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+func TestAdminAPI(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	h.dial(t, "bob")
+
+	t.Run("token", func(t *testing.T) {
+		// The right token is rejected too without the Bearer scheme.
+		for _, auth := range []string{"", "Bearer wrong", adminToken} {
+			req, _ := http.NewRequest(http.MethodGet, h.baseURL+"/admin/sessions", nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Fatalf("Authorization %q: got %s, want 401 with a Bearer challenge", auth, resp.Status)
+			}
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		var list struct {
+			PoolerID string              `json:"pooler_id"`
+			Total    int                 `json:"total"`
+			Sessions []admin.SessionInfo `json:"sessions"`
+		}
+		if code := h.admin(t, http.MethodGet, "/admin/sessions", "", &list); code != http.StatusOK {
+			t.Fatalf("list: got %d", code)
+		}
+		if list.PoolerID != "pooler-test" || list.Total != 2 || len(list.Sessions) != 2 {
+			t.Fatalf("got %+v, want both sessions", list)
+		}
+
+		h.admin(t, http.MethodGet, "/admin/sessions?client_id=alice", "", &list)
+		if list.Total != 1 || list.Sessions[0].ClientID != "alice" || list.Sessions[0].Transport != "websocket" {
+			t.Fatalf("got %+v, want alice's WebSocket session", list)
+		}
+
+		h.admin(t, http.MethodGet, "/admin/sessions?limit=1", "", &list)
+		if list.Total != 2 || len(list.Sessions) != 1 {
+			t.Fatalf("got %+v, want one of two sessions", list)
+		}
+		if code := h.admin(t, http.MethodGet, "/admin/sessions?limit=0", "", nil); code != http.StatusBadRequest {
+			t.Fatalf("limit=0: got %d, want 400", code)
+		}
+	})
+
+	t.Run("message", func(t *testing.T) {
+		var accepted struct {
+			RequestID string `json:"request_id"`
+		}
+		code := h.admin(t, http.MethodPost, "/admin/users/alice/messages", `{"hello":"world"}`, &accepted)
+		if code != http.StatusAccepted || accepted.RequestID == "" {
+			t.Fatalf("send: got %d %+v, want 202 with a request ID", code, accepted)
+		}
+		var msg struct {
+			Hello string `json:"hello"`
+		}
+		readJSON(t, alice, &msg)
+		if msg.Hello != "world" {
+			t.Fatalf("got %+v, want the test message", msg)
+		}
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		// A second pooler on the same Redis answers over the broker.
+		other, err := broker.NewRedisBroker(h.redis.Addr())
+		if err != nil {
+			t.Fatalf("broker: %v", err)
+		}
+		t.Cleanup(func() { other.Close() })
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go admin.NewHandler(websocket.NewClientManager(), other, "pooler-other", admin.Config{}).Listen(ctx)
+		eventually(t, "second pooler subscribed", func() bool {
+			return h.redis.PubSubNumSub(admin.RequestsChannel)[admin.RequestsChannel] == 2
+		})
+
+		var cluster admin.ClusterStats
+		if code := h.admin(t, http.MethodGet, "/admin/cluster", "", &cluster); code != http.StatusOK {
+			t.Fatalf("cluster: got %d", code)
+		}
+		if len(cluster.Poolers) != 2 || cluster.Sessions != 2 ||
+			cluster.Poolers[0].PoolerID != "pooler-other" || cluster.Poolers[1].PoolerID != "pooler-test" ||
+			cluster.Poolers[1].Users != 2 || cluster.Poolers[1].Transports["websocket"] != 2 {
+			t.Fatalf("got %+v, want both poolers and two sessions", cluster)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		session := h.manager.GetClientSessions("alice")[0]
+		for _, code := range []string{"999", "1005", "5000", "abc"} {
+			if got := h.admin(t, http.MethodDelete, "/admin/sessions/"+session.ConnID+"?code="+code, "", nil); got != http.StatusBadRequest {
+				t.Fatalf("code %s: got %d, want 400", code, got)
+			}
+		}
+		if got := h.admin(t, http.MethodDelete, "/admin/sessions/missing", "", nil); got != http.StatusNotFound {
+			t.Fatalf("unknown session: got %d, want 404", got)
+		}
+
+		if got := h.admin(t, http.MethodDelete, "/admin/sessions/"+session.ConnID+"?code=4000&reason=bye", "", nil); got != http.StatusNoContent {
+			t.Fatalf("close: got %d, want 204", got)
+		}
+		alice.SetReadDeadline(time.Now().Add(waitTimeout))
+		_, _, err := alice.ReadMessage()
+		var closeErr *gorilla.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != 4000 || closeErr.Text != "bye" {
+			t.Fatalf("got %v, want close 4000 bye", err)
+		}
+		eventually(t, "alice offline", func() bool { return !h.online("alice") })
+	})
+}
+
+// admin calls the admin API with the hub's token, decodes a JSON response
+// into v when it is not nil, and returns the status.
+func (h *hub) admin(t *testing.T, method, path, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, h.baseURL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode %s %s: %v", method, path, err)
+		}
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,113 @@
+package integration
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gorilla "github.com/gorilla/websocket"
+
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+func TestCompression(t *testing.T) {
+	h := startHub(t, websocket.Options{Compression: websocket.CompressionConfig{Enabled: true, Level: 1, MinBytes: 512}})
+	// Echoed back by the backend; large and very compressible, or below
+	// the threshold.
+	large := `{"type":"echo","pad":"` + strings.Repeat("a", 8192) + `"}`
+	small := `{"type":"echo","pad":"` + strings.Repeat("a", 300) + `"}`
+
+	t.Run("negotiated", func(t *testing.T) {
+		conn, wire, extensions := dialCounting(t, h, url.Values{"token": {token(t, "alice")}}, true)
+		if !strings.Contains(extensions, "permessage-deflate") {
+			t.Fatalf("got extensions %q, want permessage-deflate", extensions)
+		}
+		if n := echoWireBytes(t, conn, wire, large); n > int64(len(large))/4 {
+			t.Fatalf("large frame took %d bytes on the wire, want it compressed", n)
+		}
+		if n := echoWireBytes(t, conn, wire, small); n < int64(len(small)) {
+			t.Fatalf("small frame took %d bytes on the wire, want it sent as is", n)
+		}
+	})
+
+	t.Run("not offered", func(t *testing.T) {
+		conn, wire, extensions := dialCounting(t, h, url.Values{"token": {token(t, "bob")}}, false)
+		if extensions != "" {
+			t.Fatalf("got extensions %q, want none", extensions)
+		}
+		if n := echoWireBytes(t, conn, wire, large); n < int64(len(large)) {
+			t.Fatalf("large frame took %d bytes on the wire, want it sent as is", n)
+		}
+	})
+
+	t.Run("opted out", func(t *testing.T) {
+		conn, wire, _ := dialCounting(t, h, url.Values{"token": {token(t, "carol")}, "compress": {"false"}}, true)
+		if n := echoWireBytes(t, conn, wire, large); n < int64(len(large)) {
+			t.Fatalf("large frame took %d bytes on the wire, want it sent as is", n)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		plain := startHub(t, websocket.Options{})
+		conn, wire, extensions := dialCounting(t, plain, url.Values{"token": {token(t, "dave")}}, true)
+		if extensions != "" {
+			t.Fatalf("got extensions %q, want none", extensions)
+		}
+		if n := echoWireBytes(t, conn, wire, large); n < int64(len(large)) {
+			t.Fatalf("large frame took %d bytes on the wire, want it sent as is", n)
+		}
+	})
+}
+
+// countingConn counts the bytes a client reads off the wire.
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// dialCounting connects to h, offering permessage-deflate when compress is
+// set, and returns the connection, its byte counter and the extensions the
+// server accepted.
+func dialCounting(t *testing.T, h *hub, query url.Values, compress bool) (*gorilla.Conn, *countingConn, string) {
+	t.Helper()
+	var wire *countingConn
+	dialer := gorilla.Dialer{
+		HandshakeTimeout:  waitTimeout,
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			wire = &countingConn{Conn: conn}
+			return wire, nil
+		},
+	}
+	wsURL := "ws" + strings.TrimPrefix(h.baseURL, "http") + "/ws?" + query.Encode()
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v (%s)", err, status(resp))
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, wire, resp.Header.Get("Sec-WebSocket-Extensions")
+}
+
+// echoWireBytes sends frame and returns how many bytes its echo took on the
+// wire.
+func echoWireBytes(t *testing.T, conn *gorilla.Conn, wire *countingConn, frame string) int64 {
+	t.Helper()
+	before := wire.read.Load()
+	send(t, conn, gorilla.TextMessage, []byte(frame))
+	if _, payload := read(t, conn); !strings.Contains(string(payload), "pad") {
+		t.Fatalf("got %.100s, want the echo", payload)
+	}
+	return wire.read.Load() - before
+}
@@ -0,0 +1,4 @@
+// Package integration runs the pooler and backend in-process against an
+// embedded Redis stand-in and drives them with real WebSocket clients.
+// Run it with go test; it needs neither Docker nor a Redis server.
+package integration
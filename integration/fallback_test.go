@@ -0,0 +1,300 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/admission"
+	"github.com/wailbentafat/ws-hub/server"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+func TestSSE(t *testing.T) {
+	h := startHub(t, websocket.Options{Fallback: websocket.FallbackConfig{SSE: true}})
+	connID, events := h.openSSE(t, "sara")
+	eventually(t, "sara online", func() bool { return h.online("sara") })
+
+	if code := h.fallbackSend(t, "sara", connID, `{"type":"get_online_users"}`); code != http.StatusAccepted {
+		t.Fatalf("send: got %d, want 202", code)
+	}
+	var reply struct {
+		Type  string   `json:"type"`
+		Users []string `json:"users"`
+	}
+	if ev := nextEvent(t, events); ev.name != "" || json.Unmarshal([]byte(ev.data), &reply) != nil {
+		t.Fatalf("got event %+v, want a message", ev)
+	}
+	if reply.Type != "online_users_list" || !slices.Equal(reply.Users, []string{"sara"}) {
+		t.Fatalf("got %+v, want online_users_list of sara", reply)
+	}
+
+	// A session only accepts frames from its own user.
+	if code := h.fallbackSend(t, "mallory", connID, `{"type":"get_online_users"}`); code != http.StatusNotFound {
+		t.Fatalf("send as another user: got %d, want 404", code)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	fallback := websocket.FallbackConfig{LongPoll: true, PollTimeout: 200 * time.Millisecond, PollQueueSize: 4}
+
+	t.Run("request and response", func(t *testing.T) {
+		h := startHub(t, websocket.Options{Fallback: fallback})
+		connID := h.openPoll(t, "paul")
+		eventually(t, "paul online", func() bool { return h.online("paul") })
+
+		// An empty poll returns after the poll timeout.
+		start := time.Now()
+		if code, frames := h.poll(t, "paul", connID); code != http.StatusOK || len(frames) != 0 {
+			t.Fatalf("got %d %+v, want an empty list", code, frames)
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("empty poll returned after %s, before the poll timeout", elapsed)
+		}
+
+		if code := h.fallbackSend(t, "paul", connID, `{"type":"get_online_users"}`); code != http.StatusAccepted {
+			t.Fatalf("send: got %d, want 202", code)
+		}
+		frames := h.pollUntil(t, "paul", connID, 1)
+		if frames[0].Opcode != 1 || !strings.Contains(frames[0].Data, `"online_users_list"`) {
+			t.Fatalf("got %+v, want online_users_list", frames[0])
+		}
+	})
+
+	t.Run("queue overflow", func(t *testing.T) {
+		h := startHub(t, websocket.Options{
+			Fallback:  fallback,
+			Admission: admission.NewController(admission.Config{MaxConnectionsPerUser: 1}),
+		})
+		connID := h.openPoll(t, "quinn")
+
+		// A client that stops polling is closed like a stalled WebSocket,
+		// which releases its connection.
+		for range fallback.PollQueueSize + 2 {
+			h.fallbackSend(t, "quinn", connID, `{"type":"noise"}`)
+		}
+		eventually(t, "session closed", func() bool {
+			_, ok := h.manager.GetSession(connID)
+			return !ok
+		})
+		if code, _ := h.poll(t, "quinn", connID); code != http.StatusNotFound {
+			t.Fatalf("poll of a closed session: got %d, want 404", code)
+		}
+		h.openPoll(t, "quinn")
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		idle := fallback
+		idle.PollIdleTimeout = 300 * time.Millisecond
+		h := startHub(t, websocket.Options{Fallback: idle})
+		connID := h.openPoll(t, "ida")
+		eventually(t, "ida online", func() bool { return h.online("ida") })
+
+		eventually(t, "ida timed out", func() bool {
+			_, ok := h.manager.GetSession(connID)
+			return !ok && !h.online("ida")
+		})
+	})
+}
+
+func TestFallbackDrain(t *testing.T) {
+	h := startHub(t, websocket.Options{Fallback: websocket.FallbackConfig{
+		SSE: true, LongPoll: true, PollTimeout: 2 * time.Second, PollQueueSize: 1,
+	}})
+	_, events := h.openSSE(t, "sara")
+	polling := h.openPoll(t, "paul")
+	// stalled never polls, and its queue is full by the time the pooler
+	// drains.
+	stalled := h.openPoll(t, "stan")
+	h.fallbackSend(t, "stan", stalled, `{"type":"noise"}`)
+	eventually(t, "stan's queue full", func() bool {
+		session, ok := h.manager.GetSession(stalled)
+		return ok && session.QueueDepth() == 1
+	})
+
+	// Wait for paul's poll to be in flight; the handler marks the session
+	// active as the poll starts.
+	session, _ := h.manager.GetSession(polling)
+	opened := session.LastActivityTime()
+	polled := make(chan []fallbackFrame, 1)
+	go func() {
+		_, frames := h.poll(t, "paul", polling)
+		polled <- frames
+	}()
+	eventually(t, "paul polling", func() bool { return session.LastActivityTime().After(opened) })
+
+	start := time.Now()
+	h.shutdown(server.DrainConfig{Window: 100 * time.Millisecond, Timeout: 5 * time.Second})
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("shutdown took %s; a stalled session held it up", elapsed)
+	}
+	if n := h.manager.Count(); n != 0 {
+		t.Fatalf("%d sessions left after shutdown", n)
+	}
+
+	var reconnect websocket.ReconnectFrame
+	if ev := nextEvent(t, events); json.Unmarshal([]byte(ev.data), &reconnect) != nil || reconnect.Type != "reconnect" {
+		t.Fatalf("got event %+v, want the reconnect frame", ev)
+	}
+	var closing fallbackFrame
+	if ev := nextEvent(t, events); ev.name != "close" || json.Unmarshal([]byte(ev.data), &closing) != nil || closing.Code != 1001 {
+		t.Fatalf("got event %+v, want close with 1001", ev)
+	}
+
+	select {
+	case frames := <-polled:
+		if len(frames) == 0 || !strings.Contains(frames[0].Data, `"reconnect"`) {
+			t.Fatalf("poll got %+v, want the reconnect frame", frames)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("poll did not return")
+	}
+}
+
+// fallbackFrame is a frame of a long-poll response or an SSE close event.
+type fallbackFrame struct {
+	Opcode int    `json:"opcode"`
+	Data   string `json:"data"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type sseEvent struct {
+	name, data string
+}
+
+// openSSE opens an event stream as user and returns the session's conn_id
+// and the events that follow the open event.
+func (h *hub) openSSE(t *testing.T, user string) (string, <-chan sseEvent) {
+	t.Helper()
+	resp, err := http.Get(h.baseURL + "/sse?" + url.Values{"token": {token(t, user)}}.Encode())
+	if err != nil {
+		t.Fatalf("open event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("open event stream: %s", resp.Status)
+	}
+
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		var data []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if data != nil {
+					ev.data = strings.Join(data, "\n")
+					select {
+					case events <- ev:
+					case <-t.Context().Done():
+						return
+					}
+				}
+				ev, data = sseEvent{}, nil
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+
+	var open struct {
+		ConnID string `json:"conn_id"`
+	}
+	if ev := nextEvent(t, events); ev.name != "open" || json.Unmarshal([]byte(ev.data), &open) != nil {
+		t.Fatalf("got event %+v, want open", ev)
+	}
+	return open.ConnID, events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("event stream ended")
+		}
+		return ev
+	case <-time.After(waitTimeout):
+		t.Fatal("no event")
+	}
+	return sseEvent{}
+}
+
+// openPoll opens a long-polling session as user and returns its conn_id.
+func (h *hub) openPoll(t *testing.T, user string) string {
+	t.Helper()
+	resp, err := http.Post(h.baseURL+"/poll?"+url.Values{"token": {token(t, user)}}.Encode(), "", nil)
+	if err != nil {
+		t.Fatalf("open poll session: %v", err)
+	}
+	defer resp.Body.Close()
+	var open struct {
+		ConnID string `json:"conn_id"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&open) != nil {
+		t.Fatalf("open poll session: %s", resp.Status)
+	}
+	return open.ConnID
+}
+
+func (h *hub) fallbackURL(t *testing.T, path, user, connID string) string {
+	return h.baseURL + path + "?" + url.Values{"token": {token(t, user)}, "conn_id": {connID}}.Encode()
+}
+
+// fallbackSend posts a text frame to a session and returns the status.
+func (h *hub) fallbackSend(t *testing.T, user, connID, frame string) int {
+	t.Helper()
+	resp, err := http.Post(h.fallbackURL(t, "/send", user, connID), "application/json", strings.NewReader(frame))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// poll collects the frames queued for a long-polling session.
+func (h *hub) poll(t *testing.T, user, connID string) (int, []fallbackFrame) {
+	resp, err := http.Get(h.fallbackURL(t, "/poll", user, connID))
+	if err != nil {
+		t.Errorf("poll: %v", err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var frames []fallbackFrame
+	if err := json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+		t.Errorf("decode poll: %v", err)
+	}
+	return resp.StatusCode, frames
+}
+
+// pollUntil polls until at least n frames have arrived.
+func (h *hub) pollUntil(t *testing.T, user, connID string, n int) []fallbackFrame {
+	t.Helper()
+	var frames []fallbackFrame
+	deadline := time.Now().Add(waitTimeout)
+	for len(frames) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d frames, want %d", len(frames), n)
+		}
+		code, got := h.poll(t, user, connID)
+		if code != http.StatusOK {
+			t.Fatalf("poll: got %d", code)
+		}
+		frames = append(frames, got...)
+	}
+	return frames
+}
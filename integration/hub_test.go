@@ -0,0 +1,262 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	gorilla "github.com/gorilla/websocket"
+
+	backendbroker "github.com/wailbentafat/ws-hub/backend/broker"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/service"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+
+	"github.com/wailbentafat/ws-hub/admin"
+	"github.com/wailbentafat/ws-hub/auth"
+	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/server"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+const (
+	waitTimeout = 5 * time.Second
+	// pushToken authenticates calls to the backend's push API.
+	pushToken = "push-secret"
+	// adminToken authenticates calls to the pooler's admin API.
+	adminToken = "admin-secret"
+)
+
+func TestMain(m *testing.M) {
+	// Keep warnings and errors, which are what explains a failing test.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	os.Exit(m.Run())
+}
+
+// hub is one pooler and one backend wired to an embedded Redis.
+type hub struct {
+	redis   *miniredis.Miniredis
+	manager *websocket.ClientManager
+	handler *websocket.Handler
+	server  *server.Server
+	broker  *broker.RedisBroker
+	baseURL string
+	// pushURL is the base URL of the backend's push API.
+	pushURL string
+	stopped bool
+}
+
+func startHub(t *testing.T, opts websocket.Options) *hub {
+	t.Helper()
+	return startHubWithHooks(t, opts, nil)
+}
+
+// startHubWithHooks starts a hub whose backend reports to the given
+// webhook dispatcher.
+func startHubWithHooks(t *testing.T, opts websocket.Options, hooks *webhook.Dispatcher) *hub {
+	t.Helper()
+	mr := miniredis.RunT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// Backend
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	backendBroker, err := backendbroker.NewRedisBrokerFromClient(rdb)
+	if err != nil {
+		t.Fatalf("backend broker: %v", err)
+	}
+	store := service.NewStore(rdb)
+	svc := sdk.New(backendBroker, sdk.Options{})
+	service.Register(svc, store, hooks)
+	go svc.Run(ctx)
+	pushServer := httptest.NewServer(service.NewPushAPI(svc, store, service.PushConfig{Token: pushToken}))
+	t.Cleanup(pushServer.Close)
+
+	// Pooler
+	poolerBroker, err := broker.NewRedisBroker(mr.Addr())
+	if err != nil {
+		t.Fatalf("pooler broker: %v", err)
+	}
+	if opts.PoolerID == "" {
+		opts.PoolerID = "pooler-test"
+	}
+	manager := websocket.NewClientManager()
+	handler := websocket.NewHandler(manager, poolerBroker, opts)
+	go handler.ListenForResponses(ctx)
+
+	srv := server.NewServer("", handler.HandleWebSocket, auth.GenerateToken,
+		server.ReadinessCheck{Name: "subscription", Check: handler.CheckSubscription},
+		server.ReadinessCheck{Name: "redis", Check: poolerBroker.Ping},
+	)
+	if opts.Fallback.SSE {
+		srv.HandleSession("GET /sse", handler.HandleSSE)
+	}
+	if opts.Fallback.LongPoll {
+		srv.HandleSession("POST /poll", handler.HandlePollOpen)
+		srv.HandleFunc("GET /poll", handler.HandlePoll)
+	}
+	if opts.Fallback.SSE || opts.Fallback.LongPoll {
+		srv.HandleFunc("POST /send", handler.HandleSend)
+	}
+	adminAPI := admin.NewHandler(manager, poolerBroker, opts.PoolerID,
+		admin.Config{Token: adminToken, ClusterTimeout: 200 * time.Millisecond})
+	srv.HandleFunc("/admin/", adminAPI.ServeHTTP)
+	go adminAPI.Listen(ctx)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(ln)
+
+	h := &hub{
+		redis:   mr,
+		manager: manager,
+		handler: handler,
+		server:  srv,
+		broker:  poolerBroker,
+		baseURL: "http://" + ln.Addr().String(),
+		pushURL: pushServer.URL,
+	}
+	t.Cleanup(func() { h.shutdown(server.DrainConfig{Timeout: time.Second}) })
+
+	eventually(t, "every listener subscribed", func() bool {
+		subs := mr.PubSubNumSub(websocket.BackendRequestsChannel, websocket.BackendResponsesChannel,
+			websocket.PresenceEventsChannel, websocket.SignalEventsChannel, admin.RequestsChannel)
+		for _, n := range subs {
+			if n == 0 {
+				return false
+			}
+		}
+		return len(subs) == 5
+	})
+	return h
+}
+
+// runService runs another backend built with the sdk on the hub's Redis,
+// answering channels, until the test ends.
+func (h *hub) runService(t *testing.T, channels []string, register func(*sdk.Service)) {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: h.redis.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	mb, err := backendbroker.NewRedisBrokerFromClient(rdb)
+	if err != nil {
+		t.Fatalf("service broker: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	svc := sdk.New(mb, sdk.Options{Channels: channels})
+	register(svc)
+	go svc.Run(ctx)
+	eventually(t, "service subscribed", func() bool {
+		for _, n := range h.redis.PubSubNumSub(channels...) {
+			if n == 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// shutdown runs the pooler's graceful shutdown once.
+func (h *hub) shutdown(drain server.DrainConfig) {
+	if h.stopped {
+		return
+	}
+	h.stopped = true
+	h.server.Shutdown(context.Background(), h.manager, h.broker, drain)
+}
+
+func token(t *testing.T, user string) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": user,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(auth.JwtSecretKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+// dialRaw opens /ws with the given query and returns the handshake
+// response even when the upgrade fails.
+func (h *hub) dialRaw(query url.Values, subprotocols ...string) (*gorilla.Conn, *http.Response, error) {
+	dialer := gorilla.Dialer{HandshakeTimeout: waitTimeout, Subprotocols: subprotocols}
+	wsURL := "ws" + strings.TrimPrefix(h.baseURL, "http") + "/ws?" + query.Encode()
+	return dialer.Dial(wsURL, nil)
+}
+
+// dial connects as user and waits until the backend has recorded the
+// connection, so tests start from a settled presence state.
+func (h *hub) dial(t *testing.T, user string) *gorilla.Conn {
+	t.Helper()
+	conn, resp, err := h.dialRaw(url.Values{"token": {token(t, user)}})
+	if err != nil {
+		t.Fatalf("dial as %s: %v (%s)", user, err, status(resp))
+	}
+	t.Cleanup(func() { conn.Close() })
+	eventually(t, user+" online", func() bool { return h.online(user) })
+	return conn
+}
+
+func (h *hub) online(user string) bool {
+	ok, _ := h.redis.IsMember("online_users", user)
+	return ok
+}
+
+func status(resp *http.Response) string {
+	if resp == nil {
+		return "no response"
+	}
+	return resp.Status
+}
+
+func send(t *testing.T, conn *gorilla.Conn, messageType int, payload []byte) {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(waitTimeout))
+	if err := conn.WriteMessage(messageType, payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func read(t *testing.T, conn *gorilla.Conn) (int, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	messageType, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return messageType, payload
+}
+
+func readJSON(t *testing.T, conn *gorilla.Conn, v any) {
+	t.Helper()
+	_, payload := read(t, conn)
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("decode %s: %v", payload, err)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,1080 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/webhook"
+
+	"github.com/wailbentafat/ws-hub/admission"
+	"github.com/wailbentafat/ws-hub/ratelimit"
+	"github.com/wailbentafat/ws-hub/server"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+func TestTokenAuth(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+
+	t.Run("missing token", func(t *testing.T) {
+		_, resp, err := h.dialRaw(url.Values{})
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got %v (%s), want 401", err, status(resp))
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		_, resp, err := h.dialRaw(url.Values{"token": {"not-a-jwt"}})
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("got %v (%s), want 401", err, status(resp))
+		}
+	})
+
+	t.Run("token from get-token", func(t *testing.T) {
+		resp, err := http.Get(h.baseURL + "/get-token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		conn, resp, err := h.dialRaw(url.Values{"token": {string(tok)}})
+		if err != nil {
+			t.Fatalf("dial: %v (%s)", err, status(resp))
+		}
+		conn.Close()
+	})
+}
+
+func TestEcho(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	conn := h.dial(t, "alice")
+
+	t.Run("text", func(t *testing.T) {
+		send(t, conn, gorilla.TextMessage, []byte("hello"))
+		var got string
+		readJSON(t, conn, &got)
+		if got != "hello" {
+			t.Fatalf("got %q, want hello", got)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		frame := `{"type":"ping","n":1}`
+		send(t, conn, gorilla.TextMessage, []byte(frame))
+		var got string
+		readJSON(t, conn, &got)
+		if got != frame {
+			t.Fatalf("got %q, want %q", got, frame)
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		frame := []byte{0x00, 0xff, 0x10, 0x80}
+		send(t, conn, gorilla.BinaryMessage, frame)
+		messageType, got := read(t, conn)
+		if messageType != gorilla.BinaryMessage || !bytes.Equal(got, frame) {
+			t.Fatalf("got type %d %x, want binary %x", messageType, got, frame)
+		}
+	})
+}
+
+func TestGetOnlineUsers(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	h.dial(t, "bob")
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"get_online_users"}`))
+	var resp struct {
+		Type  string   `json:"type"`
+		Users []string `json:"users"`
+	}
+	readJSON(t, alice, &resp)
+
+	slices.Sort(resp.Users)
+	if resp.Type != "online_users_list" || !slices.Equal(resp.Users, []string{"alice", "bob"}) {
+		t.Fatalf("got %+v, want online_users_list of alice and bob", resp)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+
+	first := h.dial(t, "carol")
+	second := h.dial(t, "carol")
+
+	first.Close()
+	eventually(t, "one connection left", func() bool {
+		conns, _ := h.redis.Members("presence:conns:carol")
+		return len(conns) == 1
+	})
+	if !h.online("carol") {
+		t.Fatal("carol went offline with a connection still open")
+	}
+
+	second.Close()
+	eventually(t, "carol offline", func() bool { return !h.online("carol") })
+}
+
+func TestResponsesReachOnlyTheRequester(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	first := h.dial(t, "dave")
+	second := h.dial(t, "dave")
+
+	// A reply goes only to the connection that asked.
+	send(t, first, gorilla.TextMessage, []byte("mine"))
+	var got string
+	readJSON(t, first, &got)
+	if got != "mine" {
+		t.Fatalf("got %q, want mine", got)
+	}
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, payload, err := second.ReadMessage(); err == nil {
+		t.Fatalf("other connection received %s", payload)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	conn := h.dial(t, "erin")
+
+	drain := server.DrainConfig{
+		ReadinessDelay:    300 * time.Millisecond,
+		Window:            100 * time.Millisecond,
+		ReconnectDelayMax: time.Second,
+		Timeout:           2 * time.Second,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.shutdown(drain)
+	}()
+
+	// While the load balancer is being told, readiness fails and new
+	// connections are turned away.
+	eventually(t, "readyz failing", func() bool {
+		resp, err := http.Get(h.baseURL + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	})
+	_, resp, err := h.dialRaw(url.Values{"token": {token(t, "frank")}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial while draining: got %v (%s), want 503", err, status(resp))
+	}
+
+	var frame websocket.ReconnectFrame
+	readJSON(t, conn, &frame)
+	if frame.Type != "reconnect" || frame.ReconnectAfterMs < 0 || frame.ReconnectAfterMs >= 1000 {
+		t.Fatalf("got %+v, want a reconnect frame within 1s", frame)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	_, _, err = conn.ReadMessage()
+	var closeErr *gorilla.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != gorilla.CloseGoingAway {
+		t.Fatalf("got %v, want close 1001", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatal("shutdown did not finish")
+	}
+	eventually(t, "erin offline", func() bool { return !h.online("erin") })
+}
+
+func TestShutdownCancelled(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	conn := h.dial(t, "erin")
+
+	// A cancelled context cuts a long drain short.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.stopped = true
+	start := time.Now()
+	h.server.Shutdown(ctx, h.manager, h.broker, server.DrainConfig{Window: time.Minute, Timeout: time.Minute})
+	if elapsed := time.Since(start); elapsed > waitTimeout {
+		t.Fatalf("shutdown took %s despite the cancelled context", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var closeErr *gorilla.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != gorilla.CloseGoingAway {
+				t.Fatalf("got %v, want close 1001", err)
+			}
+			break
+		}
+	}
+}
+
+func TestErrorPaths(t *testing.T) {
+	h := startHub(t, websocket.Options{
+		Frames: websocket.FrameConfig{
+			MaxInboundBytes: 1024,
+			OversizeAction:  websocket.OversizeError,
+			ValidateJSON:    true,
+		},
+		RateLimit: ratelimit.Config{MessagesPerSecond: 1, MessageBurst: 3, Action: ratelimit.ActionThrottle},
+		Admission: admission.NewController(admission.Config{MaxConnectionsPerUser: 1, RetryAfter: 2 * time.Second}),
+	})
+
+	readError := func(t *testing.T, conn *gorilla.Conn, code string) {
+		t.Helper()
+		var frame websocket.ErrorFrame
+		readJSON(t, conn, &frame)
+		if frame.Type != "error" || frame.Code != code {
+			t.Fatalf("got %+v, want error %s", frame, code)
+		}
+	}
+
+	conn := h.dial(t, "grace")
+
+	t.Run("oversized frame", func(t *testing.T) {
+		send(t, conn, gorilla.TextMessage, []byte(`"`+strings.Repeat("x", 2048)+`"`))
+		readError(t, conn, websocket.ErrorCodeMessageTooLarge)
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		send(t, conn, gorilla.TextMessage, []byte("{not json"))
+		readError(t, conn, websocket.ErrorCodeInvalidFrame)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		for range 5 {
+			send(t, conn, gorilla.TextMessage, []byte(`{"type":"spam"}`))
+		}
+		// The burst left after the frames above is echoed, the rest is
+		// throttled with an error frame.
+		for {
+			_, payload := read(t, conn)
+			var frame websocket.ErrorFrame
+			if json.Unmarshal(payload, &frame) == nil && frame.Type == "error" {
+				if frame.Code != websocket.ErrorCodeRateLimited {
+					t.Fatalf("got %+v, want rate_limited", frame)
+				}
+				return
+			}
+		}
+	})
+
+	t.Run("connection limit", func(t *testing.T) {
+		_, resp, err := h.dialRaw(url.Values{"token": {token(t, "grace")}})
+		if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("got %v (%s), want 503", err, status(resp))
+		}
+		if got := resp.Header.Get("Retry-After"); got != "2" {
+			t.Fatalf("Retry-After %q, want 2", got)
+		}
+	})
+
+	t.Run("unsupported subprotocol", func(t *testing.T) {
+		_, resp, err := h.dialRaw(url.Values{"token": {token(t, "heidi")}}, "wshub.v9.xml")
+		if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("got %v (%s), want 400", err, status(resp))
+		}
+	})
+}
+
+func TestMsgpackClientRequests(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	conn, resp, err := h.dialRaw(url.Values{"token": {token(t, "zoe")}}, websocket.ProtocolV2Msgpack)
+	if err != nil {
+		t.Fatalf("dial: %v (%s)", err, status(resp))
+	}
+	defer conn.Close()
+	eventually(t, "zoe online", func() bool { return h.online("zoe") })
+
+	// v2 clients name the request type in the envelope.
+	frame, _ := msgpack.Marshal(map[string]any{"type": "get_online_users"})
+	send(t, conn, gorilla.BinaryMessage, frame)
+	_, payload := read(t, conn)
+
+	var env struct {
+		Data struct {
+			Type  string   `msgpack:"type"`
+			Users []string `msgpack:"users"`
+		} `msgpack:"data"`
+	}
+	if err := msgpack.Unmarshal(payload, &env); err != nil {
+		t.Fatalf("decode reply: %v", err)
+	}
+	if env.Data.Type != "online_users_list" || !slices.Equal(env.Data.Users, []string{"zoe"}) {
+		t.Fatalf("got %+v, want online_users_list of zoe", env.Data)
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	bobPhone := h.dial(t, "bob")
+	bobLaptop := h.dial(t, "bob")
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"send_direct","to":"bob","from":"mallory","body":{"text":"hi"},"client_msg_id":"c1"}`))
+
+	var receipt struct {
+		Type        string `json:"type"`
+		ID          string `json:"id"`
+		ClientMsgID string `json:"client_msg_id"`
+		Status      string `json:"status"`
+	}
+	readJSON(t, alice, &receipt)
+	if receipt.Type != "delivery_receipt" || receipt.ClientMsgID != "c1" || receipt.ID == "" {
+		t.Fatalf("got receipt %+v", receipt)
+	}
+
+	for _, conn := range []*gorilla.Conn{bobPhone, bobLaptop} {
+		var dm struct {
+			Type string          `json:"type"`
+			ID   string          `json:"id"`
+			From string          `json:"from"`
+			Body json.RawMessage `json:"body"`
+		}
+		readJSON(t, conn, &dm)
+		if dm.Type != "direct_message" || dm.From != "alice" || dm.ID != receipt.ID || string(dm.Body) != `{"text":"hi"}` {
+			t.Fatalf("got direct message %+v", dm)
+		}
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		for frame, code := range map[string]string{
+			`{"type":"send_direct","to":"nobody","body":"x"}`: "recipient_offline",
+			`{"type":"send_direct","to":"alice","body":"x"}`:  "invalid_recipient",
+			`{"type":"send_direct","to":"bob"}`:               "invalid_request",
+		} {
+			send(t, alice, gorilla.TextMessage, []byte(frame))
+			var got websocket.ErrorFrame
+			readJSON(t, alice, &got)
+			if got.Type != "error" || got.Code != code {
+				t.Errorf("%s: got %+v, want %s", frame, got, code)
+			}
+		}
+	})
+}
+
+func TestRooms(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+	carol := h.dial(t, "carol")
+
+	type frame struct {
+		Type       string          `json:"type"`
+		Code       string          `json:"code"`
+		ID         string          `json:"id"`
+		From       string          `json:"from"`
+		UserID     string          `json:"user_id"`
+		Body       json.RawMessage `json:"body"`
+		NextCursor string          `json:"next_cursor"`
+		Messages   []struct {
+			ID   string          `json:"id"`
+			Body json.RawMessage `json:"body"`
+		} `json:"messages"`
+	}
+	expect := func(t *testing.T, conn *gorilla.Conn, want string) frame {
+		t.Helper()
+		var f frame
+		readJSON(t, conn, &f)
+		if f.Type != want && f.Code != want {
+			t.Fatalf("got %+v, want %s", f, want)
+		}
+		return f
+	}
+	request := func(t *testing.T, conn *gorilla.Conn, req string, want string) frame {
+		t.Helper()
+		send(t, conn, gorilla.TextMessage, []byte(req))
+		return expect(t, conn, want)
+	}
+
+	request(t, alice, `{"type":"create_room","room_id":"general","name":"General"}`, "room_created")
+	request(t, bob, `{"type":"join_room","room_id":"general"}`, "room_joined")
+	if f := expect(t, alice, "room_member_joined"); f.UserID != "bob" {
+		t.Fatalf("got %+v, want bob joining", f)
+	}
+
+	for _, body := range []string{"1", "2", "3"} {
+		ack := request(t, bob, `{"type":"send_room_message","room_id":"general","body":`+body+`}`, "room_message_ack")
+		for _, conn := range []*gorilla.Conn{alice, bob} {
+			if f := expect(t, conn, "room_message"); f.ID != ack.ID || f.From != "bob" || string(f.Body) != body {
+				t.Fatalf("got %+v, want message %s from bob", f, body)
+			}
+		}
+	}
+
+	page := request(t, alice, `{"type":"get_history","room_id":"general","limit":2}`, "room_history")
+	if len(page.Messages) != 2 || string(page.Messages[0].Body) != "2" || string(page.Messages[1].Body) != "3" || page.NextCursor == "" {
+		t.Fatalf("first page %+v", page)
+	}
+	page = request(t, alice, `{"type":"get_history","room_id":"general","limit":2,"before":"`+page.NextCursor+`"}`, "room_history")
+	if len(page.Messages) != 1 || string(page.Messages[0].Body) != "1" || page.NextCursor != "" {
+		t.Fatalf("last page %+v", page)
+	}
+
+	request(t, alice, `{"type":"get_history","room_id":"general","before":"+ 0"}`, "invalid_request")
+	request(t, carol, `{"type":"get_history","room_id":"general"}`, "not_a_member")
+	request(t, carol, `{"type":"send_room_message","room_id":"general","body":"x"}`, "not_a_member")
+	request(t, carol, `{"type":"join_room","room_id":"missing"}`, "room_not_found")
+	request(t, carol, `{"type":"create_room","room_id":"general"}`, "room_exists")
+	request(t, carol, `{"type":"join_room","room_id":"bad:id"}`, "invalid_request")
+
+	request(t, bob, `{"type":"leave_room","room_id":"general"}`, "room_left")
+	if f := expect(t, alice, "room_member_left"); f.UserID != "bob" {
+		t.Fatalf("got %+v, want bob leaving", f)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	h := startHub(t, websocket.Options{
+		Signals: websocket.SignalConfig{Enabled: true, Rate: 100, Burst: 100, Coalesce: 100 * time.Millisecond, TTL: 300 * time.Millisecond},
+	})
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+	carol := h.dial(t, "carol")
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"create_room","room_id":"general"}`))
+	read(t, alice)
+	send(t, bob, gorilla.TextMessage, []byte(`{"type":"join_room","room_id":"general"}`))
+	read(t, bob)
+	read(t, alice) // room_member_joined
+
+	type signal struct {
+		Type   string `json:"type"`
+		Kind   string `json:"kind"`
+		From   string `json:"from"`
+		RoomID string `json:"room_id"`
+		Data   struct {
+			N int `json:"n"`
+		} `json:"data"`
+		Clear bool  `json:"clear"`
+		TTLMs int64 `json:"ttl_ms"`
+	}
+	expect := func(t *testing.T, conn *gorilla.Conn, from string, clear bool) signal {
+		t.Helper()
+		var s signal
+		readJSON(t, conn, &s)
+		if s.Type != "ephemeral" || s.Kind != "typing" || s.From != from || s.Clear != clear {
+			t.Fatalf("got %+v, want typing from %s with clear=%v", s, from, clear)
+		}
+		return s
+	}
+
+	// A burst is coalesced into the first signal and the latest one.
+	for n := 1; n <= 5; n++ {
+		send(t, alice, gorilla.TextMessage, []byte(fmt.Sprintf(`{"type":"ephemeral","kind":"typing","room_id":"general","data":{"n":%d}}`, n)))
+	}
+	if s := expect(t, bob, "alice", false); s.Data.N != 1 || s.TTLMs != 300 || s.RoomID != "general" {
+		t.Fatalf("first signal %+v", s)
+	}
+	if s := expect(t, bob, "alice", false); s.Data.N != 5 {
+		t.Fatalf("coalesced signal %+v, want n=5", s)
+	}
+
+	// Without a refresh the signal expires.
+	start := time.Now()
+	expect(t, bob, "alice", true)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("signal cleared after %s, before its TTL", elapsed)
+	}
+
+	// Signals from non-members are dropped, and so are direct signals to a
+	// user who shares no conversation with the sender. Direct signals
+	// reach users who share a room.
+	send(t, carol, gorilla.TextMessage, []byte(`{"type":"ephemeral","kind":"typing","room_id":"general"}`))
+	send(t, carol, gorilla.TextMessage, []byte(`{"type":"ephemeral","kind":"typing","to":"bob","data":{"n":1}}`))
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"ephemeral","kind":"typing","to":"bob","data":{"n":2}}`))
+	if s := expect(t, bob, "alice", false); s.Data.N != 2 || s.RoomID != "" {
+		t.Fatalf("got %+v, want the direct signal from alice", s)
+	}
+	expect(t, bob, "alice", true)
+
+	// They also reach users with a direct conversation, and only them.
+	dave := h.dial(t, "dave")
+	send(t, dave, gorilla.TextMessage, []byte(`{"type":"send_direct","to":"bob","body":"hi"}`))
+	read(t, dave) // delivery_receipt
+	var dm struct{ Type, From string }
+	if readJSON(t, bob, &dm); dm.Type != "direct_message" || dm.From != "dave" {
+		t.Fatalf("got %+v, want the direct message from dave", dm)
+	}
+	send(t, dave, gorilla.TextMessage, []byte(`{"type":"ephemeral","kind":"typing","to":"bob","data":{"n":3}}`))
+	if s := expect(t, bob, "dave", false); s.Data.N != 3 {
+		t.Fatalf("got %+v, want the signal from dave", s)
+	}
+
+	// Closing the connection clears its signals at once.
+	dave.Close()
+	expect(t, bob, "dave", true)
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"ephemeral","kind":"typing"}`))
+	var errFrame websocket.ErrorFrame
+	readJSON(t, alice, &errFrame)
+	if errFrame.Code != websocket.ErrorCodeInvalidFrame {
+		t.Fatalf("got %+v, want invalid_frame", errFrame)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+
+	type frame struct {
+		Type      string            `json:"type"`
+		Code      string            `json:"code"`
+		ID        string            `json:"id"`
+		Status    string            `json:"status"`
+		By        string            `json:"by"`
+		With      string            `json:"with"`
+		RoomID    string            `json:"room_id"`
+		Delivered map[string]string `json:"delivered"`
+		Read      map[string]string `json:"read"`
+	}
+	expect := func(t *testing.T, conn *gorilla.Conn, want string) frame {
+		t.Helper()
+		var f frame
+		readJSON(t, conn, &f)
+		if f.Type != want && f.Code != want {
+			t.Fatalf("got %+v, want %s", f, want)
+		}
+		return f
+	}
+	status := func(t *testing.T, conn *gorilla.Conn, want, id string) {
+		t.Helper()
+		if f := expect(t, conn, "message_status"); f.Status != want || f.ID != id || f.By != "bob" {
+			t.Fatalf("got %+v, want %s of %s by bob", f, want, id)
+		}
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		send(t, alice, gorilla.TextMessage, []byte(`{"type":"send_direct","to":"bob","body":"hi"}`))
+		if f := expect(t, alice, "delivery_receipt"); f.Status != "sent" {
+			t.Fatalf("got %+v, want status sent", f)
+		}
+		id := expect(t, bob, "direct_message").ID
+
+		ack := `{"type":"ack","with":"alice","id":"` + id + `"}`
+		send(t, bob, gorilla.TextMessage, []byte(ack))
+		status(t, alice, "delivered", id)
+		// A repeated ack, such as from another device, is not reported.
+		send(t, bob, gorilla.TextMessage, []byte(ack))
+		send(t, bob, gorilla.TextMessage, []byte(`{"type":"read","with":"alice","id":"`+id+`"}`))
+		status(t, alice, "read", id)
+
+		send(t, alice, gorilla.TextMessage, []byte(`{"type":"get_cursors","with":"bob"}`))
+		if f := expect(t, alice, "cursors"); f.Delivered["bob"] != id || f.Read["bob"] != id {
+			t.Fatalf("got cursors %+v, want bob at %s", f, id)
+		}
+	})
+
+	t.Run("room", func(t *testing.T) {
+		send(t, alice, gorilla.TextMessage, []byte(`{"type":"create_room","room_id":"general"}`))
+		expect(t, alice, "room_created")
+		send(t, bob, gorilla.TextMessage, []byte(`{"type":"join_room","room_id":"general"}`))
+		expect(t, bob, "room_joined")
+		expect(t, alice, "room_member_joined")
+
+		send(t, alice, gorilla.TextMessage, []byte(`{"type":"send_room_message","room_id":"general","body":"hi all"}`))
+		id := expect(t, alice, "room_message_ack").ID
+		expect(t, alice, "room_message")
+		expect(t, bob, "room_message")
+
+		send(t, bob, gorilla.TextMessage, []byte(`{"type":"ack","room_id":"general","id":"`+id+`"}`))
+		status(t, alice, "delivered", id)
+		send(t, bob, gorilla.TextMessage, []byte(`{"type":"read","room_id":"general","id":"`+id+`"}`))
+		status(t, alice, "read", id)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for req, code := range map[string]string{
+			`{"type":"ack","with":"alice","id":"1-0"}`:            "message_not_found",
+			`{"type":"ack","with":"alice","id":"nope"}`:           "invalid_request",
+			`{"type":"read","id":"1-0"}`:                          "invalid_request",
+			`{"type":"read","room_id":"missing","id":"1-0"}`:      "room_not_found",
+			`{"type":"get_cursors","with":"alice","room_id":"x"}`: "invalid_request",
+		} {
+			send(t, bob, gorilla.TextMessage, []byte(req))
+			expect(t, bob, code)
+		}
+	})
+}
+
+func TestRichPresence(t *testing.T) {
+	h := startHub(t, websocket.Options{Presence: websocket.PresenceConfig{AwayAfter: 300 * time.Millisecond}})
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+
+	type presence struct {
+		UserID   string     `json:"user_id"`
+		Status   string     `json:"status"`
+		Text     string     `json:"text"`
+		LastSeen *time.Time `json:"last_seen"`
+		Devices  int        `json:"devices"`
+	}
+	get := func(t *testing.T, users ...string) []presence {
+		t.Helper()
+		req, _ := json.Marshal(map[string]any{"type": "get_presence", "users": users})
+		send(t, bob, gorilla.TextMessage, req)
+		var reply struct {
+			Type  string     `json:"type"`
+			Users []presence `json:"users"`
+		}
+		readJSON(t, bob, &reply)
+		if reply.Type != "presence" || len(reply.Users) != len(users) {
+			t.Fatalf("got %+v, want presence of %v", reply, users)
+		}
+		return reply.Users
+	}
+
+	got := get(t, "alice", "carol")
+	if got[0].Status != "available" || got[0].Devices != 1 || got[0].LastSeen != nil {
+		t.Fatalf("alice: got %+v, want available on 1 device", got[0])
+	}
+	if got[1].Status != "offline" || got[1].Devices != 0 || got[1].LastSeen != nil {
+		t.Fatalf("carol: got %+v, want offline and never seen", got[1])
+	}
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"set_status","status":"dnd","text":"focusing"}`))
+	var own struct {
+		Users []presence `json:"users"`
+	}
+	readJSON(t, alice, &own)
+	if len(own.Users) != 1 || own.Users[0].Status != "dnd" || own.Users[0].Text != "focusing" {
+		t.Fatalf("got %+v, want alice dnd", own)
+	}
+
+	// A chosen status is kept while idle; available gives way to away.
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"set_status","status":"available"}`))
+	readJSON(t, alice, &own)
+	eventually(t, "alice away", func() bool { return get(t, "alice")[0].Status == "away" })
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"get_online_users"}`))
+	eventually(t, "alice available", func() bool { return get(t, "alice")[0].Status == "available" })
+
+	alice.Close()
+	eventually(t, "alice offline", func() bool { return get(t, "alice")[0].Status == "offline" })
+	if p := get(t, "alice")[0]; p.LastSeen == nil || time.Since(*p.LastSeen) > time.Minute || p.Devices != 0 {
+		t.Fatalf("got %+v, want a recent last_seen", p)
+	}
+
+	for _, req := range []string{
+		`{"type":"set_status","status":"busy"}`,
+		`{"type":"get_presence","users":[]}`,
+	} {
+		send(t, bob, gorilla.TextMessage, []byte(req))
+		var f struct{ Code string }
+		readJSON(t, bob, &f)
+		if f.Code != "invalid_request" {
+			t.Fatalf("%s: got %+v, want invalid_request", req, f)
+		}
+	}
+}
+
+func TestPushAPI(t *testing.T) {
+	h := startHub(t, websocket.Options{})
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+
+	push := func(t *testing.T, token, body string) (int, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, h.pushURL+"/v1/push", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("push: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]any
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+	type pushFrame struct {
+		Type  string         `json:"type"`
+		ID    string         `json:"id"`
+		Topic string         `json:"topic"`
+		Data  map[string]any `json:"data"`
+	}
+	expectPush := func(t *testing.T, conn *gorilla.Conn, id string) pushFrame {
+		t.Helper()
+		var f pushFrame
+		readJSON(t, conn, &f)
+		if f.Type != "push" || f.ID != id {
+			t.Fatalf("got %+v, want push %s", f, id)
+		}
+		return f
+	}
+
+	t.Run("users", func(t *testing.T) {
+		code, result := push(t, pushToken, `{"users":["alice","carol","alice"],"data":{"invoice":42},"queue":true}`)
+		if code != http.StatusOK {
+			t.Fatalf("got %d %v, want 200", code, result)
+		}
+		if fmt.Sprint(result["online"]) != "[alice]" || fmt.Sprint(result["offline"]) != "[carol]" || result["queued"] != 1.0 {
+			t.Fatalf("got %v, want alice online and carol queued", result)
+		}
+		if f := expectPush(t, alice, result["id"].(string)); f.Data["invoice"] != 42.0 {
+			t.Fatalf("got %+v, want the pushed data", f)
+		}
+
+		// The queued push reaches carol when she connects.
+		carol := h.dial(t, "carol")
+		expectPush(t, carol, result["id"].(string))
+	})
+
+	t.Run("topic", func(t *testing.T) {
+		send(t, alice, gorilla.TextMessage, []byte(`{"type":"create_room","room_id":"billing"}`))
+		var created struct{ Type string }
+		readJSON(t, alice, &created)
+
+		code, result := push(t, pushToken, `{"topic":"billing","data":{"plan":"pro"}}`)
+		if code != http.StatusOK || fmt.Sprint(result["online"]) != "[alice]" {
+			t.Fatalf("got %d %v, want alice reached", code, result)
+		}
+		if f := expectPush(t, alice, result["id"].(string)); f.Topic != "billing" {
+			t.Fatalf("got %+v, want topic billing", f)
+		}
+	})
+
+	t.Run("everyone", func(t *testing.T) {
+		// Record what reaches the poolers: one broadcast, not a message per
+		// user.
+		sub := h.redis.NewSubscriber()
+		sub.Subscribe(websocket.BackendResponsesChannel)
+		var mu sync.Mutex
+		var published []string
+		go func() {
+			for msg := range sub.Messages() {
+				mu.Lock()
+				published = append(published, msg.Message)
+				mu.Unlock()
+			}
+		}()
+		t.Cleanup(func() {
+			sub.Unsubscribe(websocket.BackendResponsesChannel)
+			sub.Close()
+		})
+
+		code, result := push(t, pushToken, `{"everyone":true,"data":{"maintenance":true}}`)
+		if code != http.StatusOK || fmt.Sprint(result["online"]) != "[alice bob]" {
+			t.Fatalf("got %d %v, want alice and bob reached", code, result)
+		}
+		id := result["id"].(string)
+		expectPush(t, alice, id)
+		expectPush(t, bob, id)
+
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, msg := range published {
+			if strings.Contains(msg, id) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("push published %d times, want one broadcast", n)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		for _, tc := range []struct {
+			token, body string
+			want        int
+		}{
+			{"wrong", `{"user":"alice","data":{}}`, http.StatusUnauthorized},
+			{pushToken, `{"user":"alice","users":["bob"],"data":{}}`, http.StatusBadRequest},
+			{pushToken, `{"everyone":true,"queue":true,"data":{}}`, http.StatusBadRequest},
+			{pushToken, `{"user":"alice"}`, http.StatusBadRequest},
+			{pushToken, `{"topic":"missing","data":{}}`, http.StatusNotFound},
+			{pushToken, `{"user":"alice","data":"` + strings.Repeat("x", 70<<10) + `"}`, http.StatusRequestEntityTooLarge},
+		} {
+			if code, result := push(t, tc.token, tc.body); code != tc.want {
+				t.Errorf("%.60s: got %d %v, want %d", tc.body, code, result, tc.want)
+			}
+		}
+	})
+}
+
+// receiver is a webhook endpoint stand-in that records the events it
+// accepts and answers with status until told otherwise.
+type receiver struct {
+	t      *testing.T
+	secret string
+	mu     sync.Mutex
+	status int
+	calls  int
+	events []webhook.Event
+	url    string
+}
+
+func newReceiver(t *testing.T, secret string, status int) *receiver {
+	r := &receiver{t: t, secret: secret, status: status}
+	srv := httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(srv.Close)
+	r.url = srv.URL
+	return r
+}
+
+func (r *receiver) serve(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	want := webhook.Sign(r.secret, req.Header.Get(webhook.HeaderTimestamp), body)
+	if !hmac.Equal([]byte(req.Header.Get(webhook.HeaderSignature)), []byte(want)) {
+		r.t.Errorf("bad signature on %s", body)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var ev webhook.Event
+	if err := json.Unmarshal(body, &ev); err != nil || req.Header.Get(webhook.HeaderEvent) != ev.Type {
+		r.t.Errorf("bad event %s: %v", body, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.status == http.StatusOK {
+		r.events = append(r.events, ev)
+	}
+	w.WriteHeader(r.status)
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) received(eventType, userID string) (webhook.Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range r.events {
+		if ev.Type == eventType && ev.UserID == userID {
+			return ev, true
+		}
+	}
+	return webhook.Event{}, false
+}
+
+func (r *receiver) count(eventType, userID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, ev := range r.events {
+		if ev.Type == eventType && ev.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *receiver) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func TestWebhooks(t *testing.T) {
+	lifecycle := newReceiver(t, "lifecycle-secret", http.StatusOK)
+	flaky := newReceiver(t, "flaky-secret", http.StatusServiceUnavailable)
+	rejecting := newReceiver(t, "rejecting-secret", http.StatusBadRequest)
+
+	cfg := webhook.Config{
+		Endpoints: []webhook.Endpoint{
+			{URL: lifecycle.url, Secret: lifecycle.secret, Events: []string{"user_connected", "user_disconnected", "message.send_direct"}},
+			{URL: flaky.url, Secret: flaky.secret, Events: []string{"message.*"}},
+			{URL: rejecting.url, Secret: rejecting.secret, Events: []string{"user_connected"}},
+		},
+		RetryInitial:    10 * time.Millisecond,
+		RetryMaxElapsed: 200 * time.Millisecond,
+		DeadLetterPath:  filepath.Join(t.TempDir(), "dead.jsonl"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hooks := webhook.NewDispatcher(cfg)
+	hooks.Start(ctx)
+	t.Cleanup(func() { cancel(); hooks.Wait() })
+
+	h := startHubWithHooks(t, websocket.Options{}, hooks)
+	alice := h.dial(t, "alice")
+	bob := h.dial(t, "bob")
+
+	eventually(t, "user_connected for alice", func() bool {
+		_, ok := lifecycle.received("user_connected", "alice")
+		return ok
+	})
+
+	// A request the handler rejects is not reported.
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"send_direct","to":"bob"}`))
+	var rejected struct {
+		Code string `json:"code"`
+	}
+	if readJSON(t, alice, &rejected); rejected.Code != "invalid_request" {
+		t.Fatalf("got %+v, want invalid_request", rejected)
+	}
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"send_direct","to":"bob","body":"hi"}`))
+	eventually(t, "message.send_direct from alice", func() bool {
+		ev, ok := lifecycle.received("message.send_direct", "alice")
+		return ok && strings.Contains(string(ev.Data), `"to":"bob"`)
+	})
+
+	bob.Close()
+	eventually(t, "user_disconnected for bob", func() bool {
+		_, ok := lifecycle.received("user_disconnected", "bob")
+		return ok
+	})
+
+	// The flaky endpoint is retried until the budget runs out; the
+	// rejecting one is tried once per event. Both end up dead-lettered.
+	var dead []webhook.DeadLetter
+	eventually(t, "dead letters", func() bool {
+		dead, _ = webhook.ReadDeadLetters(cfg.DeadLetterPath)
+		return len(dead) == 3
+	})
+	for _, d := range dead {
+		switch d.URL {
+		case flaky.url:
+			if d.Attempts < 2 || d.Event.Type != "message.send_direct" {
+				t.Errorf("flaky: got %+v, want a retried message.send_direct", d)
+			}
+		case rejecting.url:
+			if d.Attempts != 1 {
+				t.Errorf("rejecting: got %d attempts, want 1", d.Attempts)
+			}
+		default:
+			t.Errorf("unexpected dead letter %+v", d)
+		}
+	}
+	if n := rejecting.callCount(); n != 2 {
+		t.Errorf("rejecting endpoint called %d times, want 2", n)
+	}
+
+	// Once the flaky endpoint recovers, replay delivers its entries with
+	// their original IDs and keeps the ones that still fail.
+	flaky.setStatus(http.StatusOK)
+	result, err := webhook.Replay(context.Background(), cfg.DeadLetterPath, cfg)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if result.Delivered != 1 || result.Failed != 2 {
+		t.Fatalf("got %+v, want 1 delivered and 2 failed", result)
+	}
+	for _, d := range dead {
+		if d.URL == flaky.url {
+			if ev, ok := flaky.received(d.Event.Type, d.Event.UserID); !ok || ev.ID != d.Event.ID {
+				t.Errorf("replayed event %s not received", d.Event.ID)
+			}
+		}
+	}
+	if left, _ := webhook.ReadDeadLetters(cfg.DeadLetterPath); len(left) != 2 {
+		t.Fatalf("got %d entries left, want 2", len(left))
+	}
+	if n := lifecycle.count("message.send_direct", "alice"); n != 1 {
+		t.Fatalf("got %d message.send_direct events, want 1", n)
+	}
+
+	// v2 clients may send data that is not JSON; the event carries it as
+	// a JSON value.
+	zoe, resp, err := h.dialRaw(url.Values{"token": {token(t, "zoe")}}, websocket.ProtocolV2Msgpack)
+	if err != nil {
+		t.Fatalf("dial: %v (%s)", err, status(resp))
+	}
+	defer zoe.Close()
+	frame, _ := msgpack.Marshal(map[string]any{"type": "note", "data": "hello"})
+	send(t, zoe, gorilla.BinaryMessage, frame)
+	read(t, zoe)
+	eventually(t, "message.note from zoe", func() bool {
+		ev, ok := flaky.received("message.note", "zoe")
+		return ok && string(ev.Data) == `"hello"`
+	})
+}
+
+func TestServiceRouting(t *testing.T) {
+	h := startHub(t, websocket.Options{Routing: websocket.RoutingConfig{
+		Routes:  map[string]string{"chat": "chat-requests"},
+		Default: websocket.BackendRequestsChannel,
+	}})
+
+	// A stand-in chat service that answers every request it receives.
+	h.runService(t, []string{"chat-requests"}, func(svc *sdk.Service) {
+		svc.HandleDefault(func(c *sdk.Context) error {
+			return c.Reply(map[string]any{"type": "chat_reply", "request": string(c.Data()), "request_type": c.Message().Type})
+		})
+	})
+
+	alice := h.dial(t, "alice")
+	type reply struct {
+		Type        string `json:"type"`
+		Code        string `json:"code"`
+		Request     string `json:"request"`
+		RequestType string `json:"request_type"`
+	}
+	roundTrip := func(t *testing.T, frame string) reply {
+		t.Helper()
+		send(t, alice, gorilla.TextMessage, []byte(frame))
+		var r reply
+		readJSON(t, alice, &r)
+		return r
+	}
+
+	if r := roundTrip(t, `{"type":"get_online_users"}`); r.Type != "online_users_list" {
+		t.Fatalf("default route: got %+v", r)
+	}
+	for _, frame := range []string{`{"type":"chat.send","text":"hi"}`, `{"service":"chat","type":"send"}`} {
+		if r := roundTrip(t, frame); r.Type != "chat_reply" || r.Request != frame {
+			t.Fatalf("%s: got %+v, want it routed to chat", frame, r)
+		}
+	}
+	for _, frame := range []string{`{"type":"billing.charge"}`, `{"service":"billing","type":"charge"}`} {
+		if r := roundTrip(t, frame); r.Type != "error" || r.Code != "unknown_service" {
+			t.Fatalf("%s: got %+v, want unknown_service", frame, r)
+		}
+	}
+
+	// v2 clients route by the envelope type.
+	conn, resp, err := h.dialRaw(url.Values{"token": {token(t, "zoe")}}, websocket.ProtocolV2Msgpack)
+	if err != nil {
+		t.Fatalf("dial: %v (%s)", err, status(resp))
+	}
+	defer conn.Close()
+	frame, _ := msgpack.Marshal(map[string]any{"type": "chat.send", "data": map[string]any{"text": "hi"}})
+	send(t, conn, gorilla.BinaryMessage, frame)
+	_, payload := read(t, conn)
+	var env struct {
+		Data struct {
+			Type        string `msgpack:"type"`
+			RequestType string `msgpack:"request_type"`
+		} `msgpack:"data"`
+	}
+	if err := msgpack.Unmarshal(payload, &env); err != nil || env.Data.Type != "chat_reply" || env.Data.RequestType != "chat.send" {
+		t.Fatalf("got %+v (%v), want chat_reply to chat.send", env.Data, err)
+	}
+}
+
+func TestRoutingWithoutDefault(t *testing.T) {
+	h := startHub(t, websocket.Options{Routing: websocket.RoutingConfig{
+		Routes: map[string]string{"chat": "chat-requests"},
+	}})
+	alice := h.dial(t, "alice")
+
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"get_online_users"}`))
+	var r struct{ Type, Code string }
+	readJSON(t, alice, &r)
+	if r.Type != "error" || r.Code != "unknown_service" {
+		t.Fatalf("got %+v, want unknown_service", r)
+	}
+}
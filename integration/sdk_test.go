@@ -0,0 +1,330 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	gorilla "github.com/gorilla/websocket"
+
+	backendbroker "github.com/wailbentafat/ws-hub/backend/broker"
+	"github.com/wailbentafat/ws-hub/backend/sdk"
+	"github.com/wailbentafat/ws-hub/backend/sdk/sdktest"
+	"github.com/wailbentafat/ws-hub/backend/service"
+
+	"github.com/wailbentafat/ws-hub/auth"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+func TestSDKHandlers(t *testing.T) {
+	b := sdktest.NewBroker()
+	svc := sdk.New(b, sdk.Options{})
+
+	type shoutRequest struct {
+		Text string `json:"text"`
+	}
+	sdk.Handle(svc, "shout", func(c *sdk.Context, req shoutRequest) error {
+		if req.Text == "" {
+			return sdk.Errorf("empty_text", "text is required")
+		}
+		return c.Reply(map[string]any{
+			"type": "shouted",
+			"text": strings.ToUpper(req.Text),
+			"from": c.ClientID(),
+			"plan": c.Claims()["plan"],
+		})
+	})
+	svc.HandleRaw("fail", func(c *sdk.Context) error { return errors.New("database is down") })
+	svc.HandleRaw("panic", func(c *sdk.Context) error { panic("boom") })
+	sdk.Handle(svc, "notify", func(c *sdk.Context, req struct{ To string }) error {
+		if err := c.SendToUser(req.To, map[string]any{"type": "notified", "from": c.ClientID()}); err != nil {
+			return err
+		}
+		return c.Broadcast(map[string]any{"type": "announcement"})
+	})
+
+	var seen []string
+	var mu sync.Mutex
+	svc.Use(func(next sdk.HandlerFunc) sdk.HandlerFunc {
+		return func(c *sdk.Context) error {
+			mu.Lock()
+			seen = append(seen, c.Type())
+			mu.Unlock()
+			return next(c)
+		}
+	})
+	// Events reach their handler with the type of the event.
+	svc.HandleEvents("audit-events", func(c *sdk.Context) error {
+		return c.SendToUser(c.ClientID(), map[string]any{"type": "audited", "event": c.Type()})
+	})
+	sdktest.Run(t, b, svc)
+
+	alice := sdktest.NewClient(t, b, "alice")
+	alice.Claims["plan"] = "pro"
+	bob := sdktest.NewClient(t, b, "bob")
+
+	requestID := alice.Send(t, map[string]any{"type": "shout", "text": "hi"})
+	var shouted struct{ Type, Text, From, Plan string }
+	msg := alice.NextJSON(t, &shouted)
+	if shouted.Type != "shouted" || shouted.Text != "HI" || shouted.From != "alice" || shouted.Plan != "pro" {
+		t.Fatalf("got %+v", shouted)
+	}
+	if msg.RequestID != requestID || msg.ConnID != alice.ConnID {
+		t.Fatalf("reply carries request %q conn %q, want %q %q", msg.RequestID, msg.ConnID, requestID, alice.ConnID)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		request any
+		code    string
+	}{
+		{"handler error", map[string]any{"type": "shout"}, "empty_text"},
+		{"malformed data", map[string]any{"type": "shout", "text": 1}, sdk.ErrorCodeInvalidRequest},
+		{"unexpected error", map[string]any{"type": "fail"}, sdk.ErrorCodeInternal},
+		{"panic", map[string]any{"type": "panic"}, sdk.ErrorCodeInternal},
+		{"unknown type", map[string]any{"type": "dance"}, sdk.ErrorCodeUnknownType},
+		{"not JSON", "hello", sdk.ErrorCodeInvalidRequest},
+	} {
+		requestID := alice.Send(t, tc.request)
+		var frame sdk.ErrorFrame
+		alice.NextJSON(t, &frame)
+		if frame.Type != "error" || frame.Code != tc.code || frame.RequestID != requestID {
+			t.Errorf("%s: got %+v, want %s for %s", tc.name, frame, tc.code, requestID)
+		}
+	}
+	alice.SendBinary(t, []byte{0x01})
+	var frame sdk.ErrorFrame
+	if alice.NextJSON(t, &frame); frame.Code != sdk.ErrorCodeInvalidRequest {
+		t.Errorf("binary: got %+v, want invalid_request", frame)
+	}
+
+	alice.Send(t, map[string]any{"type": "notify", "to": "bob"})
+	var notified struct{ Type, From string }
+	if bob.NextJSON(t, &notified); notified.Type != "notified" || notified.From != "alice" {
+		t.Fatalf("bob got %+v, want notified from alice", notified)
+	}
+	for _, c := range []*sdktest.Client{bob, alice} {
+		var announcement struct{ Type string }
+		if msg := c.NextJSON(t, &announcement); announcement.Type != "announcement" || !msg.Broadcast {
+			t.Fatalf("%s got %+v, want the broadcast", c.ID, announcement)
+		}
+	}
+
+	if err := b.Publish(context.Background(), "audit-events", backendbroker.Message{Type: "login", ClientID: "bob"}); err != nil {
+		t.Fatalf("publish event: %v", err)
+	}
+	var audited struct{ Type, Event string }
+	if bob.NextJSON(t, &audited); audited.Type != "audited" || audited.Event != "login" {
+		t.Fatalf("bob got %+v, want the audited login", audited)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"shout", "shout", "shout", "fail", "panic", "dance", "", "", "notify"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("middleware saw %q, want %q", seen, want)
+	}
+}
+
+func TestSDKConcurrencyLimit(t *testing.T) {
+	b := sdktest.NewBroker()
+	svc := sdk.New(b, sdk.Options{MaxConcurrency: 2})
+
+	var running, peak atomic.Int32
+	release := make(chan struct{})
+	svc.HandleRaw("work", func(c *sdk.Context) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		<-release
+		return c.Reply(map[string]any{"type": "done"})
+	})
+	sdktest.Run(t, b, svc)
+
+	alice := sdktest.NewClient(t, b, "alice")
+	for range 5 {
+		alice.Send(t, map[string]any{"type": "work"})
+	}
+	eventually(t, "two handlers running", func() bool { return running.Load() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := running.Load(); n != 2 {
+		t.Fatalf("%d handlers running, want 2", n)
+	}
+	close(release)
+	for range 5 {
+		alice.Next(t)
+	}
+	if p := peak.Load(); p != 2 {
+		t.Fatalf("peak concurrency %d, want 2", p)
+	}
+}
+
+func TestSDKHandlerTimeout(t *testing.T) {
+	b := sdktest.NewBroker()
+	svc := sdk.New(b, sdk.Options{HandlerTimeout: 50 * time.Millisecond})
+	svc.HandleRaw("stall", func(c *sdk.Context) error {
+		<-c.Done()
+		return c.Err()
+	})
+	sdktest.Run(t, b, svc)
+
+	// The error frame goes out although the handler's context is done.
+	alice := sdktest.NewClient(t, b, "alice")
+	requestID := alice.Send(t, map[string]any{"type": "stall"})
+	var frame sdk.ErrorFrame
+	if alice.NextJSON(t, &frame); frame.Code != sdk.ErrorCodeInternal || frame.RequestID != requestID {
+		t.Fatalf("got %+v, want internal_error for %s", frame, requestID)
+	}
+}
+
+func TestSDKEventsInOrder(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	store := service.NewStore(rdb)
+	b := sdktest.NewBroker()
+	// Requests may run side by side, presence events must not: a
+	// disconnect handled before its connect would leave the user online.
+	svc := sdk.New(b, sdk.Options{MaxConcurrency: 8})
+	service.Register(svc, store, nil)
+	sdktest.Run(t, b, svc)
+
+	publish := func(eventType, userID string) {
+		t.Helper()
+		event := backendbroker.Message{Type: eventType, ClientID: userID, ConnID: userID + "-conn"}
+		if err := b.Publish(context.Background(), service.PresenceEventsChannel, event); err != nil {
+			t.Fatalf("publish %s: %v", eventType, err)
+		}
+	}
+	for i := range 50 {
+		user := fmt.Sprintf("user-%d", i)
+		publish("user_connected", user)
+		publish("user_disconnected", user)
+	}
+	publish("user_connected", "last")
+
+	eventually(t, "last online", func() bool {
+		online, err := store.IsOnline(context.Background(), "last")
+		return err == nil && online
+	})
+	users, err := store.GetOnlineUsers(context.Background())
+	if err != nil {
+		t.Fatalf("online users: %v", err)
+	}
+	if !slices.Equal(users, []string{"last"}) {
+		t.Fatalf("online users %v, want only last", users)
+	}
+}
+
+func TestSDKShutdown(t *testing.T) {
+	b := sdktest.NewBroker()
+	svc := sdk.New(b, sdk.Options{})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	svc.HandleRaw("slow", func(c *sdk.Context) error {
+		close(started)
+		<-release
+		// Shutdown does not cancel the handlers in flight.
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return c.Reply(map[string]any{"type": "finished"})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+	eventually(t, "service subscribed", func() bool { return b.Subscribers(sdk.DefaultRequestsChannel) == 1 })
+
+	alice := sdktest.NewClient(t, b, "alice")
+	alice.Send(t, map[string]any{"type": "slow"})
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned with a handler in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	var reply struct{ Type string }
+	if alice.NextJSON(t, &reply); reply.Type != "finished" {
+		t.Fatalf("got %+v, want finished", reply)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	eventually(t, "unsubscribed", func() bool { return b.Subscribers(sdk.DefaultRequestsChannel) == 0 })
+
+	// A subscription that closes underneath the service stops it with an
+	// error.
+	svc = sdk.New(b, sdk.Options{})
+	go func() { done <- svc.Run(context.Background()) }()
+	eventually(t, "service subscribed", func() bool { return b.Subscribers(sdk.DefaultRequestsChannel) == 1 })
+	b.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Run returned nil after its subscription closed")
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("Run did not return after its subscription closed")
+	}
+}
+
+func TestSDKClaimsAndBroadcast(t *testing.T) {
+	h := startHub(t, websocket.Options{Routing: websocket.RoutingConfig{
+		Routes:  map[string]string{"billing": "billing-requests"},
+		Default: websocket.BackendRequestsChannel,
+	}})
+	h.runService(t, []string{"billing-requests"}, func(svc *sdk.Service) {
+		svc.HandleRaw("billing.plan", func(c *sdk.Context) error {
+			return c.Reply(map[string]any{"type": "billing.plan", "user": c.ClientID(), "plan": c.Claims()["plan"]})
+		})
+		svc.HandleRaw("billing.maintenance", func(c *sdk.Context) error {
+			return c.Broadcast(map[string]any{"type": "maintenance", "by": c.ClientID()})
+		})
+	})
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  "alice",
+		"plan": "pro",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString(auth.JwtSecretKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	alice, resp, err := h.dialRaw(url.Values{"token": {signed}})
+	if err != nil {
+		t.Fatalf("dial: %v (%s)", err, status(resp))
+	}
+	defer alice.Close()
+	eventually(t, "alice online", func() bool { return h.online("alice") })
+	bob := h.dial(t, "bob")
+
+	// Claims come from the token, not from the frame.
+	send(t, alice, gorilla.TextMessage, []byte(`{"type":"billing.plan","claims":{"plan":"free"}}`))
+	var plan struct{ Type, User, Plan string }
+	if readJSON(t, alice, &plan); plan.User != "alice" || plan.Plan != "pro" {
+		t.Fatalf("got %+v, want alice on pro", plan)
+	}
+
+	send(t, bob, gorilla.TextMessage, []byte(`{"type":"billing.maintenance"}`))
+	for name, conn := range map[string]*gorilla.Conn{"alice": alice, "bob": bob} {
+		var notice struct{ Type, By string }
+		if readJSON(t, conn, &notice); notice.Type != "maintenance" || notice.By != "bob" {
+			t.Fatalf("%s got %+v, want the maintenance broadcast", name, notice)
+		}
+	}
+}
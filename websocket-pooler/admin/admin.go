@@ -0,0 +1,384 @@
+// Package admin serves the operator API for inspecting and managing the
+// sessions of a pooler and gathers cluster-wide stats over the broker.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	gorilla "github.com/gorilla/websocket"
+
+	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/logging"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+const (
+	// RequestsChannel carries cluster stats requests to every pooler and
+	// RepliesChannel their answers.
+	RequestsChannel = "admin-requests"
+	RepliesChannel  = "admin-replies"
+
+	statsRequestType = "admin_stats_request"
+	statsReplyType   = "admin_stats"
+
+	defaultSessionLimit = 100
+	maxMessageBytes     = 64 << 10
+)
+
+// Config configures the admin API.
+type Config struct {
+	// Token is the bearer token operators authenticate with. The API is not
+	// served when it is empty.
+	Token string
+	// ClusterTimeout is how long the cluster view waits for other poolers.
+	ClusterTimeout time.Duration
+}
+
+type Handler struct {
+	manager  *websocket.ClientManager
+	broker   broker.MessageBroker
+	poolerID string
+	cfg      Config
+	mux      *http.ServeMux
+}
+
+func NewHandler(manager *websocket.ClientManager, broker broker.MessageBroker, poolerID string, cfg Config) *Handler {
+	h := &Handler{
+		manager:  manager,
+		broker:   broker,
+		poolerID: poolerID,
+		cfg:      cfg,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /admin/sessions", h.listSessions)
+	h.mux.HandleFunc("DELETE /admin/sessions/{conn_id}", h.closeSession)
+	h.mux.HandleFunc("POST /admin/users/{client_id}/messages", h.sendMessage)
+	h.mux.HandleFunc("GET /admin/cluster", h.clusterStats)
+	return h
+}
+
+func logger() *slog.Logger {
+	return slog.Default().With("component", "admin")
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "Invalid admin token")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.cfg.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.Token)) == 1
+}
+
+// SessionInfo describes one session in the admin API.
+type SessionInfo struct {
+	ConnID       string    `json:"conn_id"`
+	ClientID     string    `json:"client_id"`
+	Transport    string    `json:"transport"`
+	Protocol     string    `json:"protocol"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	QueueDepth   int       `json:"queue_depth"`
+}
+
+func sessionInfo(s *websocket.ClientSession) SessionInfo {
+	return SessionInfo{
+		ConnID:       s.ConnID,
+		ClientID:     s.ID,
+		Transport:    s.Transport(),
+		Protocol:     s.Protocol().Name(),
+		RemoteAddr:   s.RemoteAddr,
+		ConnectedAt:  s.ConnectedAt,
+		LastActivity: s.LastActivityTime(),
+		QueueDepth:   s.QueueDepth(),
+	}
+}
+
+type sessionList struct {
+	PoolerID string        `json:"pooler_id"`
+	Total    int           `json:"total"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// listSessions returns the sessions of this pooler, oldest first. client_id
+// filters on an exact client, q on a substring of the client ID, conn ID or
+// remote address, and limit caps the result.
+func (h *Handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultSessionLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	var sessions []*websocket.ClientSession
+	if clientID := query.Get("client_id"); clientID != "" {
+		sessions = h.manager.GetClientSessions(clientID)
+	} else {
+		sessions = h.manager.Sessions()
+	}
+
+	q := query.Get("q")
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		info := sessionInfo(s)
+		if q != "" && !strings.Contains(info.ClientID, q) && !strings.Contains(info.ConnID, q) && !strings.Contains(info.RemoteAddr, q) {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	resp := sessionList{PoolerID: h.poolerID, Total: len(infos), Sessions: infos}
+	if len(infos) > limit {
+		resp.Sessions = infos[:limit]
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// closeSession disconnects one session. code defaults to 1000 and must be
+// a code a server may send: 1000, 1001, 1008, 1011 or 3000-4999.
+func (h *Handler) closeSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.manager.GetSession(r.PathValue("conn_id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	code := gorilla.CloseNormalClosure
+	if v := r.URL.Query().Get("code"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !validCloseCode(n) {
+			writeError(w, http.StatusBadRequest, "Invalid close code")
+			return
+		}
+		code = n
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Closed by operator"
+	}
+
+	session.Logger().Info("Closing connection from admin API", "code", code, "reason", reason)
+	if err := session.Close(code, reason); err != nil {
+		writeError(w, http.StatusBadGateway, "Failed to close session: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validCloseCode(code int) bool {
+	switch code {
+	case gorilla.CloseNormalClosure, gorilla.CloseGoingAway, gorilla.ClosePolicyViolation, gorilla.CloseInternalServerErr:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// sendMessage publishes a test message to every session of a user across
+// the cluster, exactly as a backend response would be. A JSON body is sent
+// as JSON; anything else is sent as a string.
+func (h *Handler) sendMessage(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read body")
+		return
+	}
+	if len(body) > maxMessageBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "Message too large")
+		return
+	}
+
+	var data any = string(body)
+	if json.Valid(body) {
+		json.Unmarshal(body, &data)
+	}
+	message := broker.Message{
+		Type:      "admin_test",
+		ClientID:  r.PathValue("client_id"),
+		Data:      data,
+		RequestID: uuid.NewString(),
+		PoolerID:  h.poolerID,
+	}
+	if err := h.broker.Publish(r.Context(), websocket.BackendResponsesChannel, message); err != nil {
+		writeError(w, http.StatusBadGateway, "Failed to publish message: "+err.Error())
+		return
+	}
+	logger().Info("Sent test message", "client_id", message.ClientID, "request_id", message.RequestID)
+	writeJSON(w, http.StatusAccepted, map[string]string{"request_id": message.RequestID})
+}
+
+// PoolerStats summarizes the sessions of one pooler. It travels as the
+// Data of a broker message, so it is tagged for every codec.
+type PoolerStats struct {
+	PoolerID   string         `json:"pooler_id" msgpack:"pooler_id"`
+	Sessions   int            `json:"sessions" msgpack:"sessions"`
+	Users      int            `json:"users" msgpack:"users"`
+	QueueDepth int            `json:"queue_depth" msgpack:"queue_depth"`
+	Transports map[string]int `json:"transports" msgpack:"transports"`
+}
+
+// ClusterStats aggregates the stats of every pooler that answered in time.
+type ClusterStats struct {
+	Poolers    []PoolerStats `json:"poolers"`
+	Sessions   int           `json:"sessions"`
+	QueueDepth int           `json:"queue_depth"`
+}
+
+// Stats summarizes the sessions of this pooler.
+func (h *Handler) Stats() PoolerStats {
+	stats := PoolerStats{PoolerID: h.poolerID, Transports: make(map[string]int)}
+	users := make(map[string]struct{})
+	for _, s := range h.manager.Sessions() {
+		stats.Sessions++
+		stats.QueueDepth += s.QueueDepth()
+		stats.Transports[s.Transport()]++
+		users[s.ID] = struct{}{}
+	}
+	stats.Users = len(users)
+	return stats
+}
+
+// Listen answers cluster stats requests from other poolers until ctx ends.
+// Every pooler runs it, whether or not it serves the admin API.
+func (h *Handler) Listen(ctx context.Context) {
+	requests, err := h.broker.Subscribe(ctx, RequestsChannel)
+	if err != nil {
+		logging.Fatal("Failed to subscribe", "channel", RequestsChannel, "error", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req, ok := <-requests:
+			if !ok {
+				logger().Error("Admin request channel closed")
+				return
+			}
+			if req.Type != statsRequestType {
+				continue
+			}
+			reply := broker.Message{
+				Type:      statsReplyType,
+				RequestID: req.RequestID,
+				PoolerID:  h.poolerID,
+				Data:      h.Stats(),
+			}
+			if err := h.broker.Publish(ctx, RepliesChannel, reply); err != nil {
+				logger().Warn("Failed to publish stats reply", "request_id", req.RequestID, "error", err)
+			}
+		}
+	}
+}
+
+// clusterStats asks every pooler for its stats and aggregates the replies
+// received within ClusterTimeout.
+func (h *Handler) clusterStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.cfg.ClusterTimeout)
+	defer cancel()
+
+	replies, err := h.broker.Subscribe(ctx, RepliesChannel)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Failed to subscribe: "+err.Error())
+		return
+	}
+	// The subscription stops once ctx ends; drain it so that a late reply
+	// cannot block its goroutine.
+	sub := replies
+	defer func() {
+		go func() {
+			for range sub {
+			}
+		}()
+	}()
+
+	requestID := uuid.NewString()
+	req := broker.Message{Type: statsRequestType, RequestID: requestID, PoolerID: h.poolerID}
+	if err := h.broker.Publish(ctx, RequestsChannel, req); err != nil {
+		writeError(w, http.StatusBadGateway, "Failed to publish: "+err.Error())
+		return
+	}
+
+	cluster := ClusterStats{Poolers: []PoolerStats{}}
+	seen := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			slices.SortFunc(cluster.Poolers, func(a, b PoolerStats) int {
+				return strings.Compare(a.PoolerID, b.PoolerID)
+			})
+			writeJSON(w, http.StatusOK, cluster)
+			return
+		case reply, ok := <-replies:
+			if !ok {
+				// Closed by ctx; the next iteration writes the result.
+				replies = nil
+				continue
+			}
+			if reply.Type != statsReplyType || reply.RequestID != requestID || seen[reply.PoolerID] {
+				continue
+			}
+			stats, err := decodeStats(reply.Data)
+			if err != nil {
+				logger().Warn("Invalid stats reply", "pooler_id", reply.PoolerID, "error", err)
+				continue
+			}
+			seen[reply.PoolerID] = true
+			cluster.Poolers = append(cluster.Poolers, stats)
+			cluster.Sessions += stats.Sessions
+			cluster.QueueDepth += stats.QueueDepth
+		}
+	}
+}
+
+// decodeStats converts the generic Data of a reply back into PoolerStats.
+func decodeStats(data any) (PoolerStats, error) {
+	var stats PoolerStats
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		return stats, err
+	}
+	if stats.PoolerID == "" {
+		return stats, errors.New("missing pooler_id")
+	}
+	return stats, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
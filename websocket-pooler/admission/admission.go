@@ -0,0 +1,205 @@
+package admission
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/metrics"
+)
+
+var (
+	ErrHandshakeLimit = errors.New("too many concurrent handshakes")
+	ErrPoolerFull     = errors.New("pooler connection limit reached")
+	ErrUserLimit      = errors.New("per-user connection limit reached")
+	ErrIPLimit        = errors.New("per-IP connection limit reached")
+)
+
+// Config holds the admission limits. A zero limit disables that check.
+type Config struct {
+	MaxConnections          int
+	MaxConnectionsPerUser   int
+	MaxConnectionsPerIP     int
+	MaxConcurrentHandshakes int
+	// RetryAfter is advertised to rejected clients.
+	RetryAfter time.Duration
+	// TrustedProxies are the networks of the proxies in front of the
+	// pooler, such as Traefik. X-Forwarded-For is only read on requests
+	// that come from one of them.
+	TrustedProxies []*net.IPNet
+}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs and IPs.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, want an IP or CIDR", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Stats is a snapshot of the admitted connections.
+type Stats struct {
+	Connections int `json:"connections"`
+	Users       int `json:"users"`
+	IPs         int `json:"ips"`
+	Handshakes  int `json:"handshakes_in_flight"`
+}
+
+// Controller decides whether a new connection may be accepted and keeps
+// count of the connections it has admitted until they are released.
+type Controller struct {
+	cfg        Config
+	handshakes chan struct{}
+
+	mu      sync.Mutex
+	total   int
+	perUser map[string]int
+	perIP   map[string]int
+}
+
+func NewController(cfg Config) *Controller {
+	c := &Controller{
+		cfg:     cfg,
+		perUser: make(map[string]int),
+		perIP:   make(map[string]int),
+	}
+	if cfg.MaxConcurrentHandshakes > 0 {
+		c.handshakes = make(chan struct{}, cfg.MaxConcurrentHandshakes)
+	}
+	return c
+}
+
+func (c *Controller) RetryAfter() time.Duration {
+	return c.cfg.RetryAfter
+}
+
+// AcquireHandshake reserves one of the handshake slots without blocking.
+func (c *Controller) AcquireHandshake() (func(), error) {
+	if c.handshakes == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.handshakes <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-c.handshakes }) }, nil
+	default:
+		metrics.AdmissionRejected.Add("handshake_limit", 1)
+		return nil, ErrHandshakeLimit
+	}
+}
+
+// Admit reserves a connection for userID from ip. The returned release
+// function must be called once the connection is closed.
+func (c *Controller) Admit(userID, ip string) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cfg.MaxConnections > 0 && c.total >= c.cfg.MaxConnections {
+		metrics.AdmissionRejected.Add("pooler_full", 1)
+		return nil, ErrPoolerFull
+	}
+	if c.cfg.MaxConnectionsPerUser > 0 && c.perUser[userID] >= c.cfg.MaxConnectionsPerUser {
+		metrics.AdmissionRejected.Add("user_limit", 1)
+		return nil, ErrUserLimit
+	}
+	if c.cfg.MaxConnectionsPerIP > 0 && c.perIP[ip] >= c.cfg.MaxConnectionsPerIP {
+		metrics.AdmissionRejected.Add("ip_limit", 1)
+		return nil, ErrIPLimit
+	}
+
+	c.total++
+	c.perUser[userID]++
+	c.perIP[ip]++
+
+	var once sync.Once
+	return func() { once.Do(func() { c.release(userID, ip) }) }, nil
+}
+
+func (c *Controller) release(userID, ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if c.perUser[userID]--; c.perUser[userID] <= 0 {
+		delete(c.perUser, userID)
+	}
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Connections: c.total,
+		Users:       len(c.perUser),
+		IPs:         len(c.perIP),
+		Handshakes:  len(c.handshakes),
+	}
+}
+
+// ClientIP returns the address the per-IP limit is applied to. Behind
+// trusted proxies it is the rightmost X-Forwarded-For hop that is not one
+// of them: each proxy appends the address it got the request from, while
+// the hops to its left may be made up by the client.
+func (c *Controller) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !c.trusted(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !c.trusted(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (c *Controller) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.cfg.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package admission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("parse proxies: %v", err)
+	}
+	controller := NewController(Config{TrustedProxies: proxies})
+
+	for _, tc := range []struct {
+		name, remote string
+		forwarded    []string
+		want         string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one proxy", "10.0.0.5:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hop", "10.0.0.5:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.5:5000", []string{"1.2.3.4, 198.51.100.1", "192.168.1.1"}, "198.51.100.1"},
+		{"garbage hop", "10.0.0.5:5000", []string{"nonsense, 10.0.0.9"}, "10.0.0.9"},
+		{"no header", "10.0.0.5:5000", nil, "10.0.0.5"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = tc.remote
+		for _, fwd := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", fwd)
+		}
+		if got := controller.ClientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parsed an invalid CIDR")
+	}
+}
@@ -2,7 +2,7 @@ package auth
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -19,7 +19,7 @@ func GenerateToken(w http.ResponseWriter, r *http.Request) {
 
 	tokenString, err := createSignedToken(userID)
 	if err != nil {
-		log.Printf("Error creating signed token: %v", err)
+		slog.Error("Error creating signed token", "error", err)
 		http.Error(w, "Failed to create token", http.StatusInternalServerError)
 		return
 	}
@@ -4,16 +4,44 @@ import (
 	"context"
 )
 
+// Opcodes of the WebSocket frame a message was received as or is to be
+// written as, using the RFC 6455 values.
+const (
+	OpcodeText   = 1
+	OpcodeBinary = 2
+)
+
 type Message struct {
-	Type     string      `json:"type,omitempty"` 
-	ClientID string      `json:"client_id"`
-	Data     interface{} `json:"data"`
+	Type     string      `json:"type,omitempty" msgpack:"type,omitempty"`
+	ClientID string      `json:"client_id" msgpack:"client_id"`
+	Data     interface{} `json:"data" msgpack:"data"`
+	// Opcode is the frame type. Text frames travel in Data; binary frames
+	// travel as raw bytes in Binary, which is base64 in the JSON envelope.
+	// A zero Opcode is treated as text for compatibility.
+	Opcode int    `json:"opcode,omitempty" msgpack:"opcode,omitempty"`
+	Binary []byte `json:"binary,omitempty" msgpack:"binary,omitempty"`
+	// RequestID, ConnID and PoolerID are stamped by the pooler on inbound
+	// frames and echoed on responses so every hop can be correlated in logs.
+	RequestID string `json:"request_id,omitempty" msgpack:"request_id,omitempty"`
+	ConnID    string `json:"conn_id,omitempty" msgpack:"conn_id,omitempty"`
+	PoolerID  string `json:"pooler_id,omitempty" msgpack:"pooler_id,omitempty"`
+	// Trace carries the W3C trace context of the publisher so consumers
+	// can continue the same trace.
+	Trace map[string]string `json:"trace,omitempty" msgpack:"trace,omitempty"`
+	// Claims are the token claims of the client, stamped by the pooler on
+	// inbound frames.
+	Claims map[string]interface{} `json:"claims,omitempty" msgpack:"claims,omitempty"`
+	// Broadcast addresses a response to every session on every pooler.
+	// ClientID and ConnID are ignored.
+	Broadcast bool `json:"broadcast,omitempty" msgpack:"broadcast,omitempty"`
 }
 
 type MessageBroker interface {
 	Publish(ctx context.Context, channel string, message Message) error
-	
+
 	Subscribe(ctx context.Context, channel string) (<-chan Message, error)
-	
+
+	Ping(ctx context.Context) error
+
 	Close() error
 }
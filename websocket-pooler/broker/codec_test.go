@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+var codecs = []Codec{JSONCodec, MsgpackCodec, ProtobufCodec}
+
+func sampleMessage() Message {
+	return Message{
+		Type:     "online_users_list",
+		ClientID: "user123",
+		Data: map[string]interface{}{
+			"type":  "online_users_list",
+			"users": []interface{}{"user123", "user456", "user789"},
+		},
+		RequestID: "5d0c7a0e-8f1e-4b36-9d47-2f7f3c1b6a10",
+		ConnID:    "a6f3b2d4-1c7e-4f0a-8b9d-3e2c5f6a7b8c",
+		PoolerID:  "pooler-1",
+		Trace: map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		Opcode: OpcodeText,
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			for _, want := range []Message{
+				sampleMessage(),
+				{ClientID: "user123", Data: `{"type":"get_online_users"}`, Opcode: OpcodeText},
+				{ClientID: "user123", Opcode: OpcodeBinary, Binary: []byte{0x00, 0xff, 0x10}},
+				{ClientID: "user123", Data: "{}", Claims: map[string]interface{}{"sub": "user123", "plan": "pro"}},
+				{Data: map[string]interface{}{"type": "notice"}, Broadcast: true},
+			} {
+				payload, err := Encode(c, want)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				var got Message
+				if err := Decode(payload, &got); err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("round trip mismatch\n got: %#v\nwant: %#v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownTag(t *testing.T) {
+	var m Message
+	if err := Decode([]byte{0x7f, 0x01}, &m); err == nil {
+		t.Fatal("expected an error for an unknown codec tag")
+	}
+}
+
+func TestRawData(t *testing.T) {
+	tests := []struct {
+		data interface{}
+		want string
+	}{
+		{`{"type":"ping"}`, `{"type":"ping"}`},
+		{map[string]interface{}{"type": "ping"}, `{"type":"ping"}`},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := Message{Data: tt.data}.RawData()
+		if err != nil {
+			t.Fatalf("RawData(%#v): %v", tt.data, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("RawData(%#v) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	m := sampleMessage()
+	for _, c := range codecs {
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				payload, err := Encode(c, m)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(payload)))
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	m := sampleMessage()
+	for _, c := range codecs {
+		payload, err := Encode(c, m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				var out Message
+				if err := Decode(payload, &out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
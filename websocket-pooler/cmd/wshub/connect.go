@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/term"
+)
+
+const msgpackProtocol = "wshub.v2.msgpack"
+
+// connFlags configure the WebSocket connection of connect and send.
+type connFlags struct {
+	serverFlags
+	protocol string
+	compress bool
+}
+
+func (f *connFlags) register(fs *flag.FlagSet) {
+	f.serverFlags.register(fs)
+	fs.StringVar(&f.protocol, "protocol", "", "subprotocol to request, e.g. wshub.v1.json or "+msgpackProtocol)
+	fs.BoolVar(&f.compress, "compress", true, "offer permessage-deflate")
+}
+
+func (f *connFlags) dial() (*websocket.Conn, error) {
+	token, err := f.resolveToken()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if !f.compress {
+		query.Set("compress", "false")
+	}
+	wsURL, err := f.wsURL(token, query)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = f.compress
+	if f.protocol != "" {
+		dialer.Subprotocols = []string{f.protocol}
+	}
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			return nil, fmt.Errorf("connect: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	return conn, nil
+}
+
+// encodeFrame turns JSON typed or read by the user into a frame in the
+// negotiated protocol.
+func encodeFrame(protocol string, text []byte) (int, []byte, error) {
+	if protocol != msgpackProtocol {
+		return websocket.TextMessage, text, nil
+	}
+	var v any
+	if err := json.Unmarshal(text, &v); err != nil {
+		return 0, nil, fmt.Errorf("%s frames must be JSON: %w", msgpackProtocol, err)
+	}
+	payload, err := msgpack.Marshal(v)
+	return websocket.BinaryMessage, payload, err
+}
+
+// formatFrame pretty-prints a received frame. JSON and msgpack frames are
+// indented; other binary frames are shown as a hex dump.
+func formatFrame(messageType int, payload []byte) string {
+	stamp := time.Now().Format("15:04:05.000")
+	if messageType == websocket.TextMessage {
+		var buf bytes.Buffer
+		if json.Indent(&buf, payload, "", "  ") == nil {
+			return fmt.Sprintf("%s <<\n%s", stamp, buf.String())
+		}
+		return fmt.Sprintf("%s << %s", stamp, payload)
+	}
+
+	var v any
+	if msgpack.Unmarshal(payload, &v) == nil {
+		if out, err := json.MarshalIndent(v, "", "  "); err == nil {
+			return fmt.Sprintf("%s << msgpack\n%s", stamp, out)
+		}
+	}
+	return fmt.Sprintf("%s << binary, %d bytes\n%s", stamp, len(payload), strings.TrimRight(hex.Dump(payload), "\n"))
+}
+
+// closeText describes why the server ended the connection.
+func closeText(err error) string {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return fmt.Sprintf("connection closed: %d %s", ce.Code, ce.Text)
+	}
+	return fmt.Sprintf("connection closed: %v", err)
+}
+
+const connectHelp = `Type a frame and press enter to send it. Commands:
+  /send <file>   send the JSON frames in a file
+  /quit          close the connection
+`
+
+func runConnect(args []string) error {
+	fs := flag.NewFlagSet("connect", flag.ExitOnError)
+	var cf connFlags
+	cf.register(fs)
+	fs.Parse(args)
+
+	conn, err := cf.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	protocol := conn.Subprotocol()
+
+	// In a terminal the prompt gets line editing and history; otherwise
+	// frames are read line by line, e.g. from a pipe.
+	var (
+		out      io.Writer = os.Stdout
+		readLine func() (string, error)
+		restore  = func() {}
+	)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		restore = func() { term.Restore(int(os.Stdin.Fd()), state) }
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "> ")
+		out, readLine = t, t.ReadLine
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+	var restoreOnce sync.Once
+	defer restoreOnce.Do(restore)
+
+	if protocol == "" {
+		protocol = "none"
+	}
+	fmt.Fprintf(out, "connected, subprotocol %s\n%s", protocol, connectHelp)
+
+	go func() {
+		for {
+			messageType, payload, err := conn.ReadMessage()
+			if err != nil {
+				fmt.Fprintln(out, closeText(err))
+				restoreOnce.Do(restore)
+				os.Exit(0)
+			}
+			fmt.Fprintln(out, formatFrame(messageType, payload))
+		}
+	}()
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case line == "/quit":
+			return closeConn(conn)
+		case line == "/help":
+			fmt.Fprint(out, connectHelp)
+			continue
+		case strings.HasPrefix(line, "/send "):
+			if err := sendFile(conn, conn.Subprotocol(), strings.TrimSpace(strings.TrimPrefix(line, "/send ")), out); err != nil {
+				fmt.Fprintln(out, "error:", err)
+			}
+			continue
+		}
+
+		messageType, payload, err := encodeFrame(conn.Subprotocol(), []byte(line))
+		if err == nil {
+			err = conn.WriteMessage(messageType, payload)
+		}
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+	return closeConn(conn)
+}
+
+func closeConn(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+}
+
+// sendFile sends every JSON value in a file as its own frame, so a file may
+// hold one frame or a stream of them. "-" reads standard input.
+func sendFile(conn *websocket.Conn, protocol, path string, out io.Writer) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var frame json.RawMessage
+		if err := dec.Decode(&frame); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: frame %d: %w", path, n, err)
+		}
+		var compact bytes.Buffer
+		json.Compact(&compact, frame)
+
+		messageType, payload, err := encodeFrame(protocol, compact.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s: frame %d: %w", path, n, err)
+		}
+		if err := conn.WriteMessage(messageType, payload); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s >> %s\n", time.Now().Format("15:04:05.000"), compact.Bytes())
+	}
+}
+
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	var cf connFlags
+	cf.register(fs)
+	wait := fs.Duration("wait", 2*time.Second, "how long to wait for responses after the last one")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: wshub send [flags] file... (- reads standard input)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := cf.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, path := range fs.Args() {
+		if err := sendFile(conn, conn.Subprotocol(), path, os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(*wait))
+		messageType, payload, err := conn.ReadMessage()
+		if err != nil {
+			var netErr interface{ Timeout() bool }
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				fmt.Println(closeText(err))
+			}
+			break
+		}
+		fmt.Println(formatFrame(messageType, payload))
+	}
+	// The connection is unusable after a read timeout, so it is closed
+	// without a close handshake.
+	return nil
+}
@@ -0,0 +1,131 @@
+// Command wshub is a client for trying out and debugging a ws-hub
+// deployment: it fetches tokens, opens interactive sessions, sends frames
+// from files and tails the broker channels between poolers and backends.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: wshub <command> [flags]
+
+Commands:
+  token     Fetch a token from /get-token
+  connect   Open an interactive session
+  send      Send JSON frames from files and print the responses
+  tail      Print messages on broker channels as they are published
+
+Run "wshub <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "token":
+		err = runToken(args)
+	case "connect":
+		err = runConnect(args)
+	case "send":
+		err = runSend(args)
+	case "tail":
+		err = runTail(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "wshub: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wshub:", err)
+		os.Exit(1)
+	}
+}
+
+// serverFlags are shared by the commands that talk to a pooler.
+type serverFlags struct {
+	server string
+	token  string
+}
+
+func (f *serverFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.server, "server", envOr("WSHUB_SERVER", "http://localhost:8080"), "pooler base URL")
+	fs.StringVar(&f.token, "token", os.Getenv("WSHUB_TOKEN"), "JWT to connect with; fetched from /get-token when empty")
+}
+
+// resolveToken returns the configured token or fetches a new one.
+func (f *serverFlags) resolveToken() (string, error) {
+	if f.token != "" {
+		return f.token, nil
+	}
+	return fetchToken(f.server)
+}
+
+// wsURL turns the base URL into the /ws endpoint with the token attached.
+func (f *serverFlags) wsURL(token string, query url.Values) (string, error) {
+	u, err := url.Parse(f.server)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func runToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	var sf serverFlags
+	sf.register(fs)
+	fs.Parse(args)
+
+	token, err := fetchToken(sf.server)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func fetchToken(server string) (string, error) {
+	resp, err := http.Get(strings.TrimSuffix(server, "/") + "/get-token")
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/broker"
+)
+
+// defaultTailChannels are the channels between poolers and backends.
+var defaultTailChannels = []string{"backend-requests", "backend-responses", "presence-events", "ephemeral-events"}
+
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	redisAddr := fs.String("redis", envOr("REDIS_ADDR", "localhost:6379"), "Redis address")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wshub tail [flags] [channel...] (default %v)\n", defaultTailChannels)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	channels := fs.Args()
+	if len(channels) == 0 {
+		channels = defaultTailChannels
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mb, err := broker.NewRedisBroker(*redisAddr)
+	if err != nil {
+		return err
+	}
+	defer mb.Close()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, channel := range channels {
+		messages, err := mb.Subscribe(ctx, channel)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range messages {
+				out, err := json.MarshalIndent(message, "", "  ")
+				if err != nil {
+					out = []byte(err.Error())
+				}
+				mu.Lock()
+				fmt.Printf("%s %s\n%s\n", time.Now().Format("15:04:05.000"), channel, out)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "tailing %v on %s\n", channels, *redisAddr)
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,350 @@
+// Command wsload simulates many clients against a pooler. Every connection
+// sends ping frames that the backend echoes back, so the reported latency
+// is the full round trip through pooler, broker and backend.
+//
+// Run it against a local pooler, Redis and backend:
+//
+//	go run ./cmd/wsload -conns 2000 -ramp 20s -rate 1000 -duration 1m
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+
+	"github.com/wailbentafat/ws-hub/auth"
+)
+
+type config struct {
+	server     string
+	conns      int
+	users      int
+	ramp       time.Duration
+	duration   time.Duration
+	rate       float64
+	size       int
+	churn      time.Duration
+	drop       time.Duration
+	drain      time.Duration
+	fetchToken bool
+	report     time.Duration
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.server, "server", "http://localhost:8080", "pooler base URL")
+	flag.IntVar(&cfg.conns, "conns", 100, "number of concurrent connections")
+	flag.IntVar(&cfg.users, "users", 0, "number of distinct users; 0 gives every connection its own")
+	flag.DurationVar(&cfg.ramp, "ramp", 10*time.Second, "time over which connections are opened")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "how long to send messages")
+	flag.Float64Var(&cfg.rate, "rate", 100, "target messages per second across all connections")
+	flag.IntVar(&cfg.size, "size", 64, "padding bytes added to every message")
+	flag.DurationVar(&cfg.churn, "churn", 0, "mean connection lifetime before a clean reconnect; 0 disables churn")
+	flag.DurationVar(&cfg.drop, "drop", 0, "mean time before a connection's TCP socket is cut without a close frame; 0 disables drops")
+	flag.DurationVar(&cfg.drain, "drain", 3*time.Second, "how long to wait for outstanding replies after sending stops")
+	flag.BoolVar(&cfg.fetchToken, "fetch-token", false, "use /get-token instead of signing a token per user")
+	flag.DurationVar(&cfg.report, "report", 5*time.Second, "progress report interval")
+	flag.Parse()
+
+	if cfg.conns <= 0 || cfg.rate <= 0 {
+		fmt.Fprintln(os.Stderr, "wsload: -conns and -rate must be positive")
+		os.Exit(2)
+	}
+	if cfg.users <= 0 {
+		cfg.users = cfg.conns
+	}
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "wsload:", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config) error {
+	wsURL, err := wsEndpoint(cfg.server)
+	if err != nil {
+		return err
+	}
+
+	var sharedToken string
+	if cfg.fetchToken {
+		if sharedToken, err = fetchToken(cfg.server); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sendCtx, cancelSend := context.WithTimeout(ctx, cfg.ramp+cfg.duration)
+	defer cancelSend()
+
+	st := newStats()
+	r := &runner{cfg: cfg, wsURL: wsURL, sharedToken: sharedToken, stats: st}
+
+	fmt.Printf("Opening %d connections over %s, sending %.0f msg/s for %s\n", cfg.conns, cfg.ramp, cfg.rate, cfg.duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := range cfg.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delay := time.Duration(int64(cfg.ramp) * int64(i) / int64(cfg.conns))
+			select {
+			case <-time.After(delay):
+			case <-sendCtx.Done():
+				return
+			}
+			r.worker(ctx, sendCtx, i)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(cfg.report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st.progress(os.Stdout, time.Since(start))
+		case <-done:
+			st.report(os.Stdout, time.Since(start))
+			return nil
+		}
+	}
+}
+
+// runner holds what every simulated client shares.
+type runner struct {
+	cfg         config
+	wsURL       string
+	sharedToken string
+	stats       *stats
+}
+
+// ping is the frame each connection sends. The backend echoes unknown
+// types back unchanged, so the reply carries the send time.
+type ping struct {
+	Type   string `json:"type"`
+	Conn   int    `json:"conn"`
+	Seq    int64  `json:"seq"`
+	SentNs int64  `json:"sent_ns"`
+	Pad    string `json:"pad,omitempty"`
+}
+
+const pingType = "load_ping"
+
+// worker keeps connection i open until sending stops, reconnecting after
+// churn, drops and errors.
+func (r *runner) worker(ctx, sendCtx context.Context, i int) {
+	for sendCtx.Err() == nil {
+		conn, err := r.dial(i)
+		if err != nil {
+			r.stats.fail(err.Error())
+			select {
+			case <-time.After(time.Second + rand.N(time.Second)):
+			case <-sendCtx.Done():
+			}
+			continue
+		}
+		r.stats.connects.Add(1)
+		r.stats.open.Add(1)
+		r.session(ctx, sendCtx, conn, i)
+		r.stats.open.Add(-1)
+	}
+}
+
+func (r *runner) dial(i int) (*websocket.Conn, error) {
+	token := r.sharedToken
+	if token == "" {
+		var err error
+		if token, err = signToken(fmt.Sprintf("load-user-%d", i%r.cfg.users)); err != nil {
+			return nil, fmt.Errorf("sign token: %w", err)
+		}
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, resp, err := dialer.Dial(r.wsURL+"?token="+url.QueryEscape(token), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("dial: %s", errorKind(err))
+	}
+	return conn, nil
+}
+
+// session runs one connection until it is churned, dropped or closed, or
+// until sending has stopped and the drain period is over.
+func (r *runner) session(ctx, sendCtx context.Context, conn *websocket.Conn, i int) {
+	defer conn.Close()
+
+	readDone := make(chan error, 1)
+	go func() { readDone <- r.read(conn) }()
+
+	interval := time.Duration(float64(time.Second) * float64(r.cfg.conns) / r.cfg.rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// Spread the first send so that connections do not tick in lockstep.
+	time.Sleep(rand.N(interval))
+
+	churn := lifetime(r.cfg.churn)
+	drop := lifetime(r.cfg.drop)
+	pad := strings.Repeat("x", r.cfg.size)
+	var seq int64
+
+	for {
+		select {
+		case err := <-readDone:
+			if sendCtx.Err() == nil {
+				r.stats.fail("read: " + errorKind(err))
+			}
+			return
+		case <-churn:
+			r.stats.churned.Add(1)
+			closeConn(conn)
+			<-readDone
+			return
+		case <-drop:
+			r.stats.dropped.Add(1)
+			conn.UnderlyingConn().Close()
+			<-readDone
+			return
+		case <-sendCtx.Done():
+			// Let outstanding replies arrive before closing.
+			select {
+			case <-time.After(r.cfg.drain):
+			case <-ctx.Done():
+			case <-readDone:
+				return
+			}
+			closeConn(conn)
+			<-readDone
+			return
+		case <-ticker.C:
+			seq++
+			frame, _ := json.Marshal(ping{Type: pingType, Conn: i, Seq: seq, SentNs: time.Now().UnixNano(), Pad: pad})
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				r.stats.fail("write: " + errorKind(err))
+				return
+			}
+			r.stats.sent.Add(1)
+		}
+	}
+}
+
+// read records the latency of every echoed ping until the connection ends.
+func (r *runner) read(conn *websocket.Conn) error {
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano()
+
+		// Text frames are echoed as a JSON string holding the original
+		// frame.
+		var inner string
+		if json.Unmarshal(payload, &inner) == nil {
+			payload = []byte(inner)
+		}
+		var p ping
+		if json.Unmarshal(payload, &p) != nil || p.Type != pingType {
+			r.stats.unmatched.Add(1)
+			continue
+		}
+		r.stats.observe(time.Duration(now - p.SentNs))
+	}
+}
+
+// lifetime returns a channel that fires after a random duration around
+// mean, or nil when mean is zero.
+func lifetime(mean time.Duration) <-chan time.Time {
+	if mean <= 0 {
+		return nil
+	}
+	return time.After(mean/2 + rand.N(mean))
+}
+
+// closeConn starts the close handshake and bounds the wait for the
+// server's close frame.
+func closeConn(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+}
+
+// errorKind shortens an error to something that groups well in the report.
+func errorKind(err error) string {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return fmt.Sprintf("close %d %s", ce.Code, ce.Text)
+	}
+	msg := err.Error()
+	// Drop addresses so that errors from different sockets group together.
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return msg
+}
+
+func signToken(userID string) (string, error) {
+	claims := jwt.MapClaims{
+		"sub": userID,
+		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(auth.JwtSecretKey)
+}
+
+func wsEndpoint(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	return u.String(), nil
+}
+
+func fetchToken(server string) (string, error) {
+	resp, err := http.Get(strings.TrimSuffix(server, "/") + "/get-token")
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch token: %s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
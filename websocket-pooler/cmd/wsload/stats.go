@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats collects the results of a load run. Counters are updated by every
+// connection; latencies are kept in full so percentiles are exact.
+type stats struct {
+	connects    atomic.Int64
+	open        atomic.Int64
+	churned     atomic.Int64
+	dropped     atomic.Int64
+	sent        atomic.Int64
+	received    atomic.Int64
+	unmatched   atomic.Int64
+	closeFrames atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+func newStats() *stats {
+	return &stats{errors: make(map[string]int)}
+}
+
+func (s *stats) observe(d time.Duration) {
+	s.received.Add(1)
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.mu.Unlock()
+}
+
+// fail counts an error by kind, such as "dial: 503 Service Unavailable".
+func (s *stats) fail(kind string) {
+	s.mu.Lock()
+	s.errors[kind]++
+	s.mu.Unlock()
+}
+
+func (s *stats) progress(w io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(w, "[%6s] open=%d sent=%d received=%d errors=%d\n",
+		elapsed.Truncate(time.Second), s.open.Load(), s.sent.Load(), s.received.Load(), s.errorCount())
+}
+
+func (s *stats) errorCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.errors {
+		n += c
+	}
+	return n
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, received := s.sent.Load(), s.received.Load()
+	fmt.Fprintf(w, "\nDuration:     %s\n", elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "Connections:  %d opened, %d churned, %d dropped\n", s.connects.Load(), s.churned.Load(), s.dropped.Load())
+	fmt.Fprintf(w, "Messages:     %d sent (%.1f/s), %d received", sent, float64(sent)/elapsed.Seconds(), received)
+	if sent > 0 {
+		fmt.Fprintf(w, ", %.2f%% lost", 100*float64(sent-min(received, sent))/float64(sent))
+	}
+	fmt.Fprintln(w)
+	if n := s.unmatched.Load(); n > 0 {
+		fmt.Fprintf(w, "Other frames: %d\n", n)
+	}
+
+	if len(s.latencies) > 0 {
+		slices.Sort(s.latencies)
+		fmt.Fprintf(w, "Round trip:   p50=%s p90=%s p99=%s max=%s\n",
+			percentile(s.latencies, 0.50), percentile(s.latencies, 0.90),
+			percentile(s.latencies, 0.99), s.latencies[len(s.latencies)-1])
+	}
+
+	if len(s.errors) > 0 {
+		fmt.Fprintln(w, "Errors:")
+		kinds := make([]string, 0, len(s.errors))
+		for kind := range s.errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Slice(kinds, func(i, j int) bool { return s.errors[kinds[i]] > s.errors[kinds[j]] })
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %6d  %s\n", s.errors[kind], kind)
+		}
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted)) + 0.5)
+	i = min(max(i-1, 0), len(sorted)-1)
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,288 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/wailbentafat/ws-hub/admin"
+	"github.com/wailbentafat/ws-hub/admission"
+	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/logging"
+	"github.com/wailbentafat/ws-hub/ratelimit"
+	"github.com/wailbentafat/ws-hub/tracing"
+	"github.com/wailbentafat/ws-hub/websocket"
+)
+
+// Config holds the pooler settings read from the environment.
+type Config struct {
+	// PoolerID identifies this instance in logs and in the broker envelope.
+	PoolerID  string
+	Addr      string
+	RedisAddr string
+	// BrokerCodec encodes published messages. Subscriptions accept all codecs.
+	BrokerCodec broker.Codec
+
+	// DrainReadinessDelay is how long the pooler keeps serving after /readyz
+	// starts failing, giving the load balancer time to stop routing to it.
+	DrainReadinessDelay time.Duration
+	// DrainWindow is the period over which open sessions are closed.
+	DrainWindow time.Duration
+	// ReconnectDelayMax bounds the randomized delay hinted to clients in
+	// the reconnect frame.
+	ReconnectDelayMax time.Duration
+	// ShutdownTimeout bounds the wait for in-flight publishes once every
+	// session has been closed.
+	ShutdownTimeout time.Duration
+
+	Tracing   tracing.Config
+	Logging   logging.Config
+	RateLimit ratelimit.Config
+	Admission admission.Config
+	Frames    websocket.FrameConfig
+
+	Compression websocket.CompressionConfig
+	Fallback    websocket.FallbackConfig
+	Signals     websocket.SignalConfig
+	Presence    websocket.PresenceConfig
+	Routing     websocket.RoutingConfig
+
+	Admin admin.Config
+}
+
+func Load() (*Config, error) {
+	cfg := &Config{
+		PoolerID:  envString("POOLER_ID", defaultPoolerID()),
+		Addr:      envString("POOLER_ADDR", ":8080"),
+		RedisAddr: envString("REDIS_ADDR", "redis:6379"),
+		Tracing: tracing.Config{
+			ServiceName: envString("OTEL_SERVICE_NAME", "ws-pooler"),
+			Exporter:    envString("TRACING_EXPORTER", tracing.ExporterNone),
+			FilePath:    envString("TRACING_FILE", "traces.jsonl"),
+		},
+		Logging: logging.Config{
+			Level:    envString("LOG_LEVEL", "info"),
+			Format:   envString("LOG_FORMAT", logging.FormatText),
+			Payloads: envString("LOG_PAYLOADS", logging.PayloadRedact),
+		},
+	}
+
+	var err error
+	if cfg.BrokerCodec, err = broker.CodecByName(envString("BROKER_CODEC", "json")); err != nil {
+		return nil, err
+	}
+	if cfg.DrainReadinessDelay, err = envDuration("DRAIN_READINESS_DELAY", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DrainWindow, err = envDuration("DRAIN_WINDOW", 20*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ReconnectDelayMax, err = envDuration("RECONNECT_DELAY_MAX", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tracing.SampleRatio, err = envFloat("TRACING_SAMPLE_RATIO", 1); err != nil {
+		return nil, err
+	}
+	if cfg.Logging.PayloadSampleRate, err = envFloat("LOG_PAYLOAD_SAMPLE_RATE", 0.01); err != nil {
+		return nil, err
+	}
+
+	if cfg.RateLimit.MessagesPerSecond, err = envFloat("RATE_LIMIT_MESSAGES_PER_SEC", 50); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit.MessageBurst, err = envInt("RATE_LIMIT_MESSAGE_BURST", 100); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit.BytesPerSecond, err = envFloat("RATE_LIMIT_BYTES_PER_SEC", 0); err != nil {
+		return nil, err
+	}
+	// The byte burst must cover the largest frame a client may send, so it
+	// defaults to one second worth of bytes.
+	if cfg.RateLimit.ByteBurst, err = envInt("RATE_LIMIT_BYTE_BURST", int(cfg.RateLimit.BytesPerSecond)); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit.UserMessagesPerSecond, err = envInt("RATE_LIMIT_USER_MESSAGES_PER_SEC", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimit.Action, err = ratelimit.ParseAction(envString("RATE_LIMIT_ACTION", string(ratelimit.ActionThrottle))); err != nil {
+		return nil, err
+	}
+
+	if cfg.Admission.MaxConnections, err = envInt("MAX_CONNECTIONS", 10000); err != nil {
+		return nil, err
+	}
+	if cfg.Admission.MaxConnectionsPerUser, err = envInt("MAX_CONNECTIONS_PER_USER", 10); err != nil {
+		return nil, err
+	}
+	if cfg.Admission.MaxConnectionsPerIP, err = envInt("MAX_CONNECTIONS_PER_IP", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Admission.MaxConcurrentHandshakes, err = envInt("MAX_CONCURRENT_HANDSHAKES", 100); err != nil {
+		return nil, err
+	}
+	if cfg.Admission.RetryAfter, err = envDuration("ADMISSION_RETRY_AFTER", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Admission.TrustedProxies, err = admission.ParseTrustedProxies(envString("TRUSTED_PROXIES", "")); err != nil {
+		return nil, err
+	}
+
+	maxInbound, err := envInt("MAX_INBOUND_MESSAGE_BYTES", 64<<10)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Frames.MaxInboundBytes = int64(maxInbound)
+	if cfg.Frames.MaxOutboundBytes, err = envInt("MAX_OUTBOUND_MESSAGE_BYTES", 1<<20); err != nil {
+		return nil, err
+	}
+	if cfg.Frames.OversizeAction, err = websocket.ParseOversizeAction(envString("OVERSIZE_ACTION", websocket.OversizeClose)); err != nil {
+		return nil, err
+	}
+	if cfg.Frames.ValidateUTF8, err = envBool("VALIDATE_UTF8", false); err != nil {
+		return nil, err
+	}
+	if cfg.Frames.ValidateJSON, err = envBool("VALIDATE_JSON", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.Compression.Enabled, err = envBool("COMPRESSION_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.Compression.Level, err = envInt("COMPRESSION_LEVEL", 1); err != nil {
+		return nil, err
+	}
+	if cfg.Compression.MinBytes, err = envInt("COMPRESSION_MIN_BYTES", 1024); err != nil {
+		return nil, err
+	}
+
+	if cfg.Fallback.SSE, err = envBool("SSE_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.Fallback.LongPoll, err = envBool("LONG_POLL_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.Fallback.PollTimeout, err = envDuration("POLL_TIMEOUT", 25*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Fallback.PollQueueSize, err = envInt("POLL_QUEUE_SIZE", 256); err != nil {
+		return nil, err
+	}
+	if cfg.Fallback.PollIdleTimeout, err = envDuration("POLL_IDLE_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.Signals.Enabled, err = envBool("SIGNALS_ENABLED", true); err != nil {
+		return nil, err
+	}
+	if cfg.Signals.Rate, err = envFloat("SIGNAL_RATE", 10); err != nil {
+		return nil, err
+	}
+	if cfg.Signals.Burst, err = envInt("SIGNAL_BURST", 20); err != nil {
+		return nil, err
+	}
+	if cfg.Signals.Coalesce, err = envDuration("SIGNAL_COALESCE", 250*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.Signals.TTL, err = envDuration("SIGNAL_TTL", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Signals.MaxDataBytes, err = envInt("SIGNAL_MAX_DATA_BYTES", 512); err != nil {
+		return nil, err
+	}
+
+	if cfg.Presence.AwayAfter, err = envDuration("PRESENCE_AWAY_AFTER", 5*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.Routing.Routes, err = websocket.ParseRoutes(envString("ROUTES", "")); err != nil {
+		return nil, err
+	}
+	// "none" sends frames that name no service back as unknown_service.
+	if cfg.Routing.Default = envString("DEFAULT_ROUTE", websocket.BackendRequestsChannel); cfg.Routing.Default == "none" {
+		cfg.Routing.Default = ""
+	}
+
+	cfg.Admin.Token = envString("ADMIN_TOKEN", "")
+	if cfg.Admin.ClusterTimeout, err = envDuration("ADMIN_CLUSTER_TIMEOUT", time.Second); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// defaultPoolerID uses the hostname, which is the container ID under Swarm,
+// and falls back to a random ID.
+func defaultPoolerID() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return uuid.NewString()
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", key, v)
+	}
+	return d, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", key, v)
+	}
+	return n, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// PayloadRedact logs only the size of message bodies.
+	PayloadRedact = "redact"
+	// PayloadSample logs a truncated body for a fraction of messages.
+	PayloadSample = "sample"
+	// PayloadFull logs every body, truncated. Intended for local debugging.
+	PayloadFull = "full"
+
+	maxLoggedPayload = 256
+)
+
+// Config selects the level, output format and payload policy of the
+// process-wide logger.
+type Config struct {
+	Level             string
+	Format            string
+	Payloads          string
+	PayloadSampleRate float64
+}
+
+var payloadPolicy = Config{Payloads: PayloadRedact}
+
+// Setup installs the default slog logger. Every record it emits carries
+// attrs, which callers use for process-level identity such as pooler_id.
+func Setup(cfg Config, attrs ...any) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	switch cfg.Payloads {
+	case PayloadRedact, PayloadSample, PayloadFull:
+	default:
+		return fmt.Errorf("invalid payload logging mode %q", cfg.Payloads)
+	}
+	payloadPolicy = cfg
+
+	slog.SetDefault(slog.New(handler).With(attrs...))
+	return nil
+}
+
+// Payload returns a log attribute describing a message body according to
+// the configured policy. The size is always logged; the body itself only
+// when the policy allows it, and never more than maxLoggedPayload bytes.
+func Payload(data []byte) slog.Attr {
+	attrs := []any{slog.Int("size", len(data))}
+
+	include := false
+	switch payloadPolicy.Payloads {
+	case PayloadFull:
+		include = true
+	case PayloadSample:
+		include = rand.Float64() < payloadPolicy.PayloadSampleRate
+	}
+	if include {
+		body := data
+		if len(body) > maxLoggedPayload {
+			body = body[:maxLoggedPayload]
+		}
+		attrs = append(attrs, slog.String("body", string(body)))
+	}
+
+	return slog.Group("payload", attrs...)
+}
+
+// Fatal logs at error level and exits, standing in for log.Fatalf.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
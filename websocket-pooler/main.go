@@ -2,14 +2,24 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/go-redis/redis/v8"
+
+	"github.com/wailbentafat/ws-hub/admin"
+	"github.com/wailbentafat/ws-hub/admission"
 	"github.com/wailbentafat/ws-hub/auth"
 	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/config"
+	"github.com/wailbentafat/ws-hub/logging"
+	"github.com/wailbentafat/ws-hub/metrics"
+	"github.com/wailbentafat/ws-hub/ratelimit"
 	"github.com/wailbentafat/ws-hub/server"
+	"github.com/wailbentafat/ws-hub/tracing"
 	"github.com/wailbentafat/ws-hub/websocket"
 )
 
@@ -17,27 +27,98 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	messageBroker, err := broker.NewRedisBroker("redis:6379")
+	cfg, err := config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	if err := logging.Setup(cfg.Logging, "pooler_id", cfg.PoolerID); err != nil {
+		logging.Fatal("Invalid logging configuration", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "error", err)
+	}
+	defer func() {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer flushCancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Error("Tracing shutdown error", "error", err)
+		}
+	}()
+
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+	if err := rdb.Ping(pingCtx).Err(); err != nil {
+		logging.Fatal("Failed to connect to Redis", "error", err)
+	}
+	pingCancel()
+
+	messageBroker, err := broker.NewRedisBrokerFromClient(rdb, broker.WithCodec(cfg.BrokerCodec))
 	if err != nil {
-		log.Fatalf("Failed to create Redis broker: %v", err)
+		logging.Fatal("Failed to create Redis broker", "error", err)
 	}
-	defer messageBroker.Close()
 
 	clientManager := websocket.NewClientManager()
 
-	handler := websocket.NewHandler(clientManager, messageBroker)
+	admissionController := admission.NewController(cfg.Admission)
+	metrics.SetGauge("admission", func() any { return admissionController.Stats() })
+
+	handlerOpts := websocket.Options{
+		PoolerID:  cfg.PoolerID,
+		RateLimit: cfg.RateLimit,
+		Admission: admissionController,
+		Frames:    cfg.Frames,
+
+		Compression: cfg.Compression,
+		Fallback:    cfg.Fallback,
+		Signals:     cfg.Signals,
+		Presence:    cfg.Presence,
+		Routing:     cfg.Routing,
+	}
+	if cfg.RateLimit.UserMessagesPerSecond > 0 {
+		handlerOpts.UserLimiter = ratelimit.NewUserLimiter(rdb, cfg.RateLimit.UserMessagesPerSecond)
+		go handlerOpts.UserLimiter.Run(ctx)
+	}
+	handler := websocket.NewHandler(clientManager, messageBroker, handlerOpts)
+
+	srv := server.NewServer(cfg.Addr, handler.HandleWebSocket, auth.GenerateToken,
+		server.ReadinessCheck{Name: "subscription", Check: handler.CheckSubscription},
+		server.ReadinessCheck{Name: "redis", Check: messageBroker.Ping},
+	)
+	if cfg.Fallback.SSE {
+		srv.HandleSession("GET /sse", handler.HandleSSE)
+	}
+	if cfg.Fallback.LongPoll {
+		srv.HandleSession("POST /poll", handler.HandlePollOpen)
+		srv.HandleFunc("GET /poll", handler.HandlePoll)
+	}
+	if cfg.Fallback.SSE || cfg.Fallback.LongPoll {
+		srv.HandleFunc("POST /send", handler.HandleSend)
+	}
 
-    srv := server.NewServer(":8080", handler.HandleWebSocket, auth.GenerateToken)
+	adminAPI := admin.NewHandler(clientManager, messageBroker, cfg.PoolerID, cfg.Admin)
+	if cfg.Admin.Token != "" {
+		srv.HandleFunc("/admin/", adminAPI.ServeHTTP)
+	}
 
 	go handler.ListenForResponses(ctx)
+	go adminAPI.Listen(ctx)
 
 	go srv.Start()
-	log.Println("WebSocket pooler started on :8080")
+	slog.Info("WebSocket pooler started", "addr", cfg.Addr)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Shutdown signal received")
+	slog.Info("Shutdown signal received")
 
-	srv.Shutdown(ctx, clientManager, messageBroker)
+	// Shutdown closes the broker once the connections have drained.
+	srv.Shutdown(ctx, clientManager, messageBroker, server.DrainConfig{
+		ReadinessDelay:    cfg.DrainReadinessDelay,
+		Window:            cfg.DrainWindow,
+		ReconnectDelayMax: cfg.ReconnectDelayMax,
+		Timeout:           cfg.ShutdownTimeout,
+	})
 }
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"expvar"
+	"time"
+)
+
+// Outbound write counters, split by whether permessage-deflate was used.
+// The connection compresses as it writes, so the times cover the whole
+// write, socket I/O included; comparing the nanoseconds per payload byte of
+// the two approximates the cost of compression. Wire bytes over payload
+// bytes gives its ratio.
+var (
+	compressedWrites       = expvar.NewInt("compressed_writes_total")
+	compressedPayloadBytes = expvar.NewInt("compressed_payload_bytes_total")
+	compressedWireBytes    = expvar.NewInt("compressed_wire_bytes_total")
+	compressedWriteNanos   = expvar.NewInt("compressed_write_ns_total")
+
+	plainWrites       = expvar.NewInt("plain_writes_total")
+	plainPayloadBytes = expvar.NewInt("plain_payload_bytes_total")
+	plainWriteNanos   = expvar.NewInt("plain_write_ns_total")
+)
+
+func init() {
+	SetGauge("compression", func() any {
+		return map[string]float64{
+			"ratio":                      ratio(compressedWireBytes.Value(), compressedPayloadBytes.Value()),
+			"compressed_write_ns_per_kb": ratio(compressedWriteNanos.Value()*1024, compressedPayloadBytes.Value()),
+			"plain_write_ns_per_kb":      ratio(plainWriteNanos.Value()*1024, plainPayloadBytes.Value()),
+		}
+	})
+}
+
+// ObserveWrite records one outbound frame. wireBytes is negative when the
+// connection is not counted, which only happens outside Server.Start.
+func ObserveWrite(compressed bool, payloadBytes int, wireBytes int64, d time.Duration) {
+	if !compressed {
+		plainWrites.Add(1)
+		plainPayloadBytes.Add(int64(payloadBytes))
+		plainWriteNanos.Add(d.Nanoseconds())
+		return
+	}
+	compressedWrites.Add(1)
+	compressedPayloadBytes.Add(int64(payloadBytes))
+	compressedWriteNanos.Add(d.Nanoseconds())
+	if wireBytes >= 0 {
+		compressedWireBytes.Add(wireBytes)
+	}
+}
+
+func ratio(num, den int64) float64 {
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// CountingConn counts the bytes written to the underlying connection, which
+// after a WebSocket upgrade is the wire size of every frame sent.
+type CountingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *CountingConn) BytesWritten() int64 {
+	return c.written.Load()
+}
+
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &CountingConn{Conn: c}, nil
+}
+
+// CountingListener wraps every accepted connection in a CountingConn.
+func CountingListener(l net.Listener) net.Listener {
+	return countingListener{Listener: l}
+}
+
+type connKey struct{}
+
+// ConnContext is an http.Server ConnContext hook that makes the
+// CountingConn of a request available to its handler.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if cc, ok := c.(*CountingConn); ok {
+		return context.WithValue(ctx, connKey{}, cc)
+	}
+	return ctx
+}
+
+// ConnFromContext returns the CountingConn stored by ConnContext, or nil.
+func ConnFromContext(ctx context.Context) *CountingConn {
+	cc, _ := ctx.Value(connKey{}).(*CountingConn)
+	return cc
+}
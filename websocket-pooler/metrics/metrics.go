@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+)
+
+// Counters shared across packages. They are published through expvar and
+// served as JSON on /metrics together with the registered gauges.
+var (
+	AdmissionRejected = expvar.NewMap("admission_rejected_total")
+	FramesRejected    = expvar.NewMap("frames_rejected_total")
+	// Signals counts ephemeral signals by outcome: published, coalesced,
+	// rate_limited, expired, dropped and publish_failed.
+	Signals = expvar.NewMap("signals_total")
+)
+
+var (
+	gaugesMu sync.RWMutex
+	gauges   = make(map[string]func() any)
+)
+
+func init() {
+	expvar.Publish("gauges", expvar.Func(func() any {
+		gaugesMu.RLock()
+		defer gaugesMu.RUnlock()
+
+		values := make(map[string]any, len(gauges))
+		for name, fn := range gauges {
+			values[name] = fn()
+		}
+		return values
+	}))
+}
+
+// SetGauge registers fn to report the current value of name, replacing any
+// earlier registration under the same name.
+func SetGauge(name string, fn func() any) {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+	gauges[name] = fn
+}
+
+func Handler() http.Handler {
+	return expvar.Handler()
+}
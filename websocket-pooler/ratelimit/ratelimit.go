@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+// Action is what the pooler does with a frame that exceeds a limit.
+type Action string
+
+const (
+	// ActionThrottle drops the frame and tells the client with an error frame.
+	ActionThrottle Action = "throttle"
+	// ActionDrop silently drops the frame.
+	ActionDrop Action = "drop"
+	// ActionClose closes the connection.
+	ActionClose Action = "close"
+)
+
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case ActionThrottle, ActionDrop, ActionClose:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown rate limit action %q", s)
+}
+
+// Config holds the inbound limits. A zero rate disables that limit.
+type Config struct {
+	MessagesPerSecond     float64
+	MessageBurst          int
+	BytesPerSecond        float64
+	ByteBurst             int
+	UserMessagesPerSecond int
+	Action                Action
+}
+
+// ConnLimiter applies per-connection token buckets to inbound frames.
+type ConnLimiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+func NewConnLimiter(cfg Config) *ConnLimiter {
+	l := &ConnLimiter{}
+	if cfg.MessagesPerSecond > 0 {
+		l.messages = rate.NewLimiter(rate.Limit(cfg.MessagesPerSecond), max(cfg.MessageBurst, 1))
+	}
+	if cfg.BytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(cfg.BytesPerSecond), max(cfg.ByteBurst, 1))
+	}
+	return l
+}
+
+// Allow reports whether a frame of size bytes fits within the connection's
+// budget, consuming tokens only when it does.
+func (l *ConnLimiter) Allow(size int) bool {
+	now := time.Now()
+
+	if l.messages != nil {
+		r := l.messages.ReserveN(now, 1)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			return false
+		}
+		if l.bytes != nil {
+			b := l.bytes.ReserveN(now, size)
+			if !b.OK() || b.DelayFrom(now) > 0 {
+				b.CancelAt(now)
+				r.CancelAt(now)
+				return false
+			}
+		}
+		return true
+	}
+
+	if l.bytes != nil {
+		return l.bytes.AllowN(now, size)
+	}
+	return true
+}
+
+const userKeyPrefix = "ratelimit:user:"
+
+// DefaultSyncInterval is how often a UserLimiter reports its counts to
+// Redis.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// UserLimiter enforces a cluster-wide per-user message rate shared by all
+// poolers, using a fixed one-second window counter in Redis. Frames are
+// checked against a local token bucket of the same rate and counted in
+// memory; Run adds the counts to Redis in batches and learns from the
+// totals which users are over the limit for the rest of the window. The
+// cluster-wide limit can thus be exceeded by what the other poolers admit
+// within one sync interval.
+type UserLimiter struct {
+	client       *redis.Client
+	limit        int
+	syncInterval time.Duration
+	// now returns the current time; tests replace it to control windows.
+	now func() time.Time
+
+	mu    sync.Mutex
+	users map[string]*userState
+}
+
+type userState struct {
+	local *rate.Limiter
+	// pending counts the frames admitted since the last sync.
+	pending int64
+	// blocked is the window, in Unix seconds, that the user went over the
+	// limit in.
+	blocked int64
+}
+
+func NewUserLimiter(client *redis.Client, messagesPerSecond int) *UserLimiter {
+	return &UserLimiter{
+		client:       client,
+		limit:        messagesPerSecond,
+		syncInterval: DefaultSyncInterval,
+		now:          time.Now,
+		users:        make(map[string]*userState),
+	}
+}
+
+// Allow reports whether a frame from userID is within the limit and counts
+// it if so. It does not wait for Redis.
+func (u *UserLimiter) Allow(userID string) bool {
+	now := u.now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	st, ok := u.users[userID]
+	if !ok {
+		st = &userState{local: rate.NewLimiter(rate.Limit(u.limit), max(u.limit, 1))}
+		u.users[userID] = st
+	}
+	if st.blocked == now.Unix() || !st.local.AllowN(now, 1) {
+		return false
+	}
+	st.pending++
+	return true
+}
+
+// Run syncs the counts to Redis every sync interval until ctx is done. A
+// failed sync is logged and its counts are dropped, so that an unreachable
+// Redis lets traffic through rather than blocking it.
+func (u *UserLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := u.Sync(ctx); err != nil {
+				slog.Warn("User rate limit sync failed", "error", err)
+			}
+		}
+	}
+}
+
+// Sync adds the frames counted since the last sync to the users' counters
+// for the current window and blocks the users whose counter went over the
+// limit. Users with nothing pending and a full bucket are forgotten.
+func (u *UserLimiter) Sync(ctx context.Context) error {
+	now := u.now()
+	window := now.Unix()
+	batch := make(map[string]int64)
+	u.mu.Lock()
+	for userID, st := range u.users {
+		switch {
+		case st.pending > 0:
+			batch[userID] = st.pending
+			st.pending = 0
+		case st.blocked < window && st.local.TokensAt(now) >= float64(st.local.Burst()):
+			delete(u.users, userID)
+		}
+	}
+	u.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]*redis.IntCmd, len(batch))
+	_, err := u.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for userID, n := range batch {
+			key := fmt.Sprintf("%s%s:%d", userKeyPrefix, userID, window)
+			counts[userID] = pipe.IncrBy(ctx, key, n)
+			pipe.Expire(ctx, key, 2*time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("sync %d user rate limits: %w", len(batch), err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for userID, count := range counts {
+		if count.Val() <= int64(u.limit) {
+			continue
+		}
+		if st, ok := u.users[userID]; ok {
+			st.blocked = window
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestUserLimiter(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	// Two poolers share a limit of 5 messages per second per user, and
+	// both see the clock stand still within one window.
+	window := time.Unix(1_700_000_000, 0)
+	clock := func() time.Time { return window }
+	a := NewUserLimiter(rdb, 5)
+	b := NewUserLimiter(rdb, 5)
+	a.now, b.now = clock, clock
+
+	for i := range 5 {
+		if !a.Allow("ivan") {
+			t.Fatalf("frame %d refused", i)
+		}
+	}
+	if a.Allow("ivan") {
+		t.Fatal("local bucket let a sixth frame through")
+	}
+	if err := a.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// The other pooler admits a frame before it learns of the count, then
+	// refuses the user for the rest of the window.
+	if !b.Allow("ivan") {
+		t.Fatal("other pooler refused a frame before syncing")
+	}
+	if err := b.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if b.Allow("ivan") {
+		t.Fatal("other pooler let a frame through after the user went over the limit")
+	}
+	if !b.Allow("judy") {
+		t.Fatal("another user was refused")
+	}
+
+	// The next window starts with a fresh count.
+	window = window.Add(time.Second)
+	if !b.Allow("ivan") {
+		t.Fatal("user still refused in the next window")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// ReadinessCheck is a named dependency probe run by the /readyz endpoint.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.Draining() {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	failed := make(map[string]string)
+	for _, check := range s.readinessChecks {
+		if err := check.Check(ctx); err != nil {
+			failed[check.Name] = err.Error()
+		}
+	}
+
+	if len(failed) > 0 {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not_ready", Checks: failed})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ready"})
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
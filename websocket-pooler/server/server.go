@@ -2,51 +2,136 @@ package server
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/logging"
+	"github.com/wailbentafat/ws-hub/metrics"
 	"github.com/wailbentafat/ws-hub/websocket"
 )
 
 type Server struct {
-	httpServer *http.Server
+	httpServer      *http.Server
+	mux             *http.ServeMux
+	readinessChecks []ReadinessCheck
+	draining        atomic.Bool
 }
 
-func NewServer(addr string, wsHandler http.HandlerFunc, tokenHandler http.HandlerFunc) *Server {
+func NewServer(addr string, wsHandler http.HandlerFunc, tokenHandler http.HandlerFunc, checks ...ReadinessCheck) *Server {
+	s := &Server{
+		readinessChecks: checks,
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", wsHandler)
-	mux.HandleFunc("/get-token", tokenHandler) 
+	s.mux = mux
+	mux.HandleFunc("/ws", s.rejectWhenDraining(wsHandler))
+	mux.HandleFunc("/get-token", tokenHandler)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
 
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	s.httpServer = &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		ConnContext: metrics.ConnContext,
 	}
 
-	return &Server{
-		httpServer: srv,
+	return s
+}
+
+// HandleSession registers an endpoint that opens client sessions. Like /ws,
+// it refuses new sessions while the pooler is draining.
+func (s *Server) HandleSession(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.rejectWhenDraining(handler))
+}
+
+// HandleFunc registers an endpoint that serves existing sessions.
+func (s *Server) HandleFunc(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// SetDraining marks the server as draining so /readyz starts failing.
+func (s *Server) SetDraining() {
+	s.draining.Store(true)
+}
+
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+func (s *Server) rejectWhenDraining(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Draining() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
 	}
 }
 
 func (s *Server) Start() {
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed: %v", err)
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		logging.Fatal("Server failed", "error", err)
 	}
+	if err := s.Serve(ln); err != nil {
+		logging.Fatal("Server failed", "error", err)
+	}
+}
+
+// Serve serves on ln until Shutdown. Connections are wrapped to count the
+// bytes written to them, so compression metrics can report wire sizes.
+func (s *Server) Serve(ln net.Listener) error {
+	if err := s.httpServer.Serve(metrics.CountingListener(ln)); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// DrainConfig controls how Shutdown hands clients off to other poolers.
+type DrainConfig struct {
+	ReadinessDelay    time.Duration
+	Window            time.Duration
+	ReconnectDelayMax time.Duration
+	Timeout           time.Duration
 }
 
-func (s *Server) Shutdown(ctx context.Context, clientManager *websocket.ClientManager, broker broker.MessageBroker) {
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
+// Shutdown drains the sessions, stops the HTTP server and closes the
+// broker. It hurries through whatever is left, closing the remaining
+// sessions at once, when ctx is done or the drain's total time is up.
+func (s *Server) Shutdown(ctx context.Context, clientManager *websocket.ClientManager, broker broker.MessageBroker, drain DrainConfig) {
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, drain.ReadinessDelay+drain.Window+drain.Timeout)
 	defer shutdownCancel()
 
-	log.Println("Shutting down HTTP server...")
-	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+	slog.Info("Draining: marking pooler as not ready")
+	s.SetDraining()
+	select {
+	case <-time.After(drain.ReadinessDelay):
+	case <-shutdownCtx.Done():
 	}
 
-	log.Println("Closing WebSocket connections...")
+	// SSE and long-poll requests stay active until their sessions are
+	// closed, so the HTTP server shuts down while the sessions drain.
+	slog.Info("Shutting down HTTP server")
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("HTTP server shutdown error", "error", err)
+		}
+	}()
+
+	slog.Info("Draining client connections")
+	clientManager.Drain(shutdownCtx, drain.Window, drain.ReconnectDelayMax)
 	clientManager.CloseAllConnections("Server shutting down")
-	log.Println("Waiting for pending operations...")
+	<-httpDone
+
+	slog.Info("Waiting for pending operations")
 	done := make(chan struct{})
 	go func() {
 		clientManager.WaitForCompletion()
@@ -55,15 +140,15 @@ func (s *Server) Shutdown(ctx context.Context, clientManager *websocket.ClientMa
 
 	select {
 	case <-done:
-		log.Println("All operations completed")
+		slog.Info("All operations completed")
 	case <-shutdownCtx.Done():
-		log.Println("Shutdown timeout exceeded, forcing exit")
+		slog.Warn("Shutdown timeout exceeded, forcing exit")
 	}
 
-	log.Println("Closing message broker...")
+	slog.Info("Closing message broker")
 	if err := broker.Close(); err != nil {
-		log.Printf("Broker closure error: %v", err)
+		slog.Error("Broker closure error", "error", err)
 	}
 
-	log.Println("Shutdown complete")
+	slog.Info("Shutdown complete")
 }
@@ -2,12 +2,21 @@ package websocket
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wailbentafat/ws-hub/metrics"
+	"github.com/wailbentafat/ws-hub/ratelimit"
 )
 
 const (
@@ -15,39 +24,162 @@ const (
 	activityTimeout     = 60 * time.Second
 	writeWait           = 5 * time.Second
 	websocketRetryDelay = 200 * time.Millisecond
+	websocketMaxRetries = 3
 )
 
 type ClientSession struct {
-	ID           string
-	conn         *websocket.Conn
+	ID string
+	// ConnID distinguishes this connection from other connections of the
+	// same client.
+	ConnID string
+	// ConnectedAt and RemoteAddr describe the connection for operators.
+	// RemoteAddr is the address admission limits were applied to.
+	ConnectedAt  time.Time
+	RemoteAddr   string
+	protocol     Protocol
+	transport    transport
+	log          *slog.Logger
 	lastActivity int64 // UnixNano timestamp
 	mu           sync.Mutex
+	pending      atomic.Int64 // writes waiting for mu
+
+	// wire counts the bytes written to the socket; nil when unavailable.
+	wire *metrics.CountingConn
+	// compress is set when permessage-deflate was negotiated and is not
+	// turned off for this session.
+	compress    atomic.Bool
+	negotiated  bool
+	compressMin int
+
+	// limiter bounds the inbound frame rate; handshake links each frame's
+	// trace back to the handshake.
+	limiter   *ratelimit.ConnLimiter
+	handshake trace.Link
+	// claims are the token claims stamped on the session's requests.
+	claims map[string]any
+	// signals holds the ephemeral signals this session has active.
+	signals *signalState
+	// idle reports the session idle after a period without input; nil when
+	// idle reporting is off.
+	idle *idleState
+	// events publishes the session's signals and presence changes off the
+	// read loop.
+	events outbox
 }
 
 func NewClientSession(id string, conn *websocket.Conn) *ClientSession {
+	return newSession(id, wsTransport{conn: conn}, negotiatedProtocol(conn))
+}
+
+func newSession(id string, t transport, protocol Protocol) *ClientSession {
+	connID := uuid.NewString()
 	return &ClientSession{
 		ID:           id,
-		conn:         conn,
+		ConnID:       connID,
+		ConnectedAt:  time.Now(),
+		protocol:     protocol,
+		transport:    t,
+		log:          logger().With("conn_id", connID, "client_id", id, "transport", t.name()),
 		lastActivity: time.Now().UnixNano(),
 	}
 }
 
+// configureCompression applies the compression settings after the upgrade.
+// Frames are only compressed when permessage-deflate was negotiated.
+func (s *ClientSession) configureCompression(cfg CompressionConfig, negotiated bool, wire *metrics.CountingConn) {
+	s.compressMin = cfg.MinBytes
+	s.negotiated = negotiated
+	s.wire = wire
+	s.compress.Store(negotiated)
+}
+
+// SetCompression turns compression of outbound frames on or off for this
+// session. It has no effect if permessage-deflate was not negotiated.
+func (s *ClientSession) SetCompression(enabled bool) {
+	s.compress.Store(enabled && s.negotiated)
+}
+
+// Protocol returns the subprotocol negotiated during the handshake.
+func (s *ClientSession) Protocol() Protocol {
+	return s.protocol
+}
+
+// Transport names the transport the client is connected over: websocket,
+// sse or poll.
+func (s *ClientSession) Transport() string {
+	return s.transport.name()
+}
+
+// QueueDepth is the number of outbound frames not yet written: writes
+// blocked behind a slow client plus frames buffered by the transport.
+func (s *ClientSession) QueueDepth() int {
+	return int(s.pending.Load()) + s.transport.queued()
+}
+
+// Logger returns a logger annotated with the session's connection and
+// client IDs.
+func (s *ClientSession) Logger() *slog.Logger {
+	return s.log
+}
+
 func (s *ClientSession) SafeWriteJSON(data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode frame: %w", err)
+	}
+	return s.SafeWrite(websocket.TextMessage, payload)
+}
+
+// SafeWriteFrame writes a pooler-generated frame in the session's protocol.
+func (s *ClientSession) SafeWriteFrame(frame any) error {
+	messageType, payload, err := s.protocol.EncodeFrame(frame)
+	if err != nil {
+		return fmt.Errorf("encode frame: %w", err)
+	}
+	return s.SafeWrite(messageType, payload)
+}
+
+// SafeWrite writes one frame, serialized with every other write on the
+// session and retried a bounded number of times.
+func (s *ClientSession) SafeWrite(messageType int, payload []byte) error {
+	s.pending.Add(1)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.pending.Add(-1)
+
+	compressed := s.compress.Load() && len(payload) >= s.compressMin
+
+	wireBefore := int64(-1)
+	if s.wire != nil {
+		wireBefore = s.wire.BytesWritten()
+	}
+	start := time.Now()
 
 	operation := func() error {
-		return s.conn.WriteJSON(data)
+		return s.transport.writeFrame(messageType, payload, compressed)
 	}
 
 	backoffStrategy := backoff.WithContext(
-		backoff.NewConstantBackOff(websocketRetryDelay),
+		backoff.WithMaxRetries(
+			backoff.NewConstantBackOff(websocketRetryDelay),
+			websocketMaxRetries,
+		),
 		context.Background(),
 	)
 
-	return backoff.RetryNotify(operation, backoffStrategy, func(err error, d time.Duration) {
-		log.Printf("Retrying WebSocket write: %v (next attempt in %s)", err, d)
+	err := backoff.RetryNotify(operation, backoffStrategy, func(err error, d time.Duration) {
+		s.log.Warn("Retrying write", "error", err, "retry_in", d)
 	})
+	if err != nil {
+		return err
+	}
+
+	wireBytes := int64(-1)
+	if s.wire != nil {
+		wireBytes = s.wire.BytesWritten() - wireBefore
+	}
+	metrics.ObserveWrite(compressed, len(payload), wireBytes, time.Since(start))
+	return nil
 }
 
 func (s *ClientSession) UpdateActivity() {
@@ -65,26 +197,24 @@ func (s *ClientSession) StartPingSender(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			s.conn.WriteControl(
-				websocket.PingMessage,
-				nil,
-				time.Now().Add(writeWait),
-			)
+			s.transport.writePing()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (s *ClientSession) StartActivityChecker(ctx context.Context, onTimeout func()) {
-	ticker := time.NewTicker(10 * time.Second)
+// StartActivityChecker closes the transport and calls onTimeout once the
+// session has been inactive for longer than timeout.
+func (s *ClientSession) StartActivityChecker(ctx context.Context, timeout time.Duration, onTimeout func()) {
+	ticker := time.NewTicker(min(10*time.Second, timeout/6))
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			if time.Since(s.LastActivityTime()) > activityTimeout {
-				s.conn.Close()
+			if time.Since(s.LastActivityTime()) > timeout {
+				s.transport.close()
 				onTimeout()
 				return
 			}
@@ -94,19 +224,16 @@ func (s *ClientSession) StartActivityChecker(ctx context.Context, onTimeout func
 	}
 }
 
+// Close sends a close frame and closes the transport. The transport is
+// closed even when the frame cannot be sent, so that a stalled client
+// cannot keep its session open.
 func (s *ClientSession) Close(code int, text string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	err := s.conn.WriteControl(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(code, text),
-		time.Now().Add(writeWait),
-	)
-	if err != nil {
-		log.Printf("Error sending close message: %v", err)
-		return err
+	writeErr := s.transport.writeClose(code, text)
+	if writeErr != nil {
+		s.log.Warn("Error sending close message", "error", writeErr)
 	}
-
-	return s.conn.Close()
+	return errors.Join(writeErr, s.transport.close())
 }
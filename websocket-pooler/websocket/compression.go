@@ -0,0 +1,40 @@
+package websocket
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls permessage-deflate. Frames smaller than
+// MinBytes are sent uncompressed even on connections that negotiated it.
+type CompressionConfig struct {
+	Enabled  bool
+	Level    int
+	MinBytes int
+}
+
+// compressionOffered reports whether the client offered permessage-deflate,
+// which the upgrader accepts whenever compression is enabled.
+func compressionOffered(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(ext, ",") {
+			name, _, _ := strings.Cut(offer, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressionRequested lets a client opt out of compression for its
+// connection with ?compress=false even if its library offers the extension.
+func compressionRequested(r *http.Request) bool {
+	v := r.URL.Query().Get("compress")
+	if v == "" {
+		return true
+	}
+	enabled, err := strconv.ParseBool(v)
+	return err != nil || enabled
+}
@@ -0,0 +1,439 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wailbentafat/ws-hub/metrics"
+)
+
+// FallbackConfig enables the HTTP transports for clients whose network
+// blocks the WebSocket upgrade. Both share authentication, admission,
+// presence and response delivery with /ws.
+type FallbackConfig struct {
+	SSE      bool
+	LongPoll bool
+	// PollTimeout is how long a poll request waits for frames.
+	PollTimeout time.Duration
+	// PollQueueSize bounds the frames buffered between two polls.
+	PollQueueSize int
+	// PollIdleTimeout closes a long-polling session that has neither
+	// polled nor sent for this long.
+	PollIdleTimeout time.Duration
+}
+
+var (
+	errTransportClosed = errors.New("transport closed")
+	errPollQueueFull   = errors.New("poll queue full")
+)
+
+func (c FallbackConfig) pollIdleTimeout() time.Duration {
+	if c.PollIdleTimeout <= 0 {
+		return activityTimeout
+	}
+	return c.PollIdleTimeout
+}
+
+// closeOpcode marks the close frame of the fallback transports, matching
+// the WebSocket close opcode.
+const closeOpcode = 8
+
+// requestedProtocol picks the message format of a fallback session from
+// the protocol query parameter, since there is no subprotocol header.
+func requestedProtocol(r *http.Request) (Protocol, error) {
+	name := r.URL.Query().Get("protocol")
+	if name == "" {
+		return protocolV1, nil
+	}
+	if p, ok := protocolByName(name); ok {
+		return p, nil
+	}
+	return nil, errUnsupportedProtocol
+}
+
+// sseTransport writes frames as Server-Sent Events. Text frames are sent as
+// message events and binary frames as base64 in binary events.
+type sseTransport struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	closed bool
+	done   chan struct{}
+}
+
+func newSSETransport(w http.ResponseWriter) *sseTransport {
+	return &sseTransport{
+		w:    w,
+		rc:   http.NewResponseController(w),
+		done: make(chan struct{}),
+	}
+}
+
+func (*sseTransport) name() string { return "sse" }
+
+// writeEvent writes one event and flushes it. Every line of data gets its
+// own data field so that multi-line payloads survive.
+func (t *sseTransport) writeEvent(event string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errTransportClosed
+	}
+
+	var buf bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+	return t.write(buf.Bytes())
+}
+
+func (t *sseTransport) write(p []byte) error {
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) writeFrame(messageType int, payload []byte, _ bool) error {
+	if messageType == websocket.BinaryMessage {
+		return t.writeEvent("binary", []byte(base64.StdEncoding.EncodeToString(payload)))
+	}
+	return t.writeEvent("", payload)
+}
+
+func (*sseTransport) queued() int { return 0 }
+
+func (t *sseTransport) writePing() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errTransportClosed
+	}
+	return t.write([]byte(": ping\n\n"))
+}
+
+func (t *sseTransport) writeClose(code int, text string) error {
+	data, err := json.Marshal(pollFrame{Opcode: closeOpcode, Code: code, Reason: text})
+	if err != nil {
+		return err
+	}
+	return t.writeEvent("close", data)
+}
+
+// close stops all writes; the response must not be touched once the
+// handler has returned.
+func (t *sseTransport) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+// pollFrame is one frame in a long-poll response.
+type pollFrame struct {
+	Opcode int    `json:"opcode"`
+	Data   string `json:"data,omitempty"`
+	Binary []byte `json:"binary,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// pollTransport buffers frames until the client collects them with a poll
+// request. A client that stops polling fills the queue, and its writes
+// fail like those of a stalled WebSocket.
+type pollTransport struct {
+	mu     sync.Mutex
+	queue  []pollFrame
+	limit  int
+	closed bool
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func newPollTransport(limit int) *pollTransport {
+	return &pollTransport{
+		limit:  limit,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (*pollTransport) name() string { return "poll" }
+
+// push queues frame. A limited push fails once the queue is full; the
+// close frame is not limited, so that it always reaches a client that
+// polls again.
+func (t *pollTransport) push(frame pollFrame, limited bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errTransportClosed
+	}
+	if limited && t.limit > 0 && len(t.queue) >= t.limit {
+		return errPollQueueFull
+	}
+	t.queue = append(t.queue, frame)
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (t *pollTransport) writeFrame(messageType int, payload []byte, _ bool) error {
+	if messageType == websocket.BinaryMessage {
+		return t.push(pollFrame{Opcode: websocket.BinaryMessage, Binary: payload}, true)
+	}
+	return t.push(pollFrame{Opcode: websocket.TextMessage, Data: string(payload)}, true)
+}
+
+func (t *pollTransport) queued() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue)
+}
+
+func (t *pollTransport) writePing() error { return nil }
+
+func (t *pollTransport) writeClose(code int, text string) error {
+	return t.push(pollFrame{Opcode: closeOpcode, Code: code, Reason: text}, false)
+}
+
+func (t *pollTransport) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+// poll waits up to timeout for frames and returns everything queued. It
+// reports closed once the transport is closed and its queue is drained.
+func (t *pollTransport) poll(ctx context.Context, timeout time.Duration) (frames []pollFrame, closed bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		if len(t.queue) > 0 || t.closed {
+			frames, t.queue = t.queue, nil
+			closed = t.closed && len(frames) == 0
+			t.mu.Unlock()
+			return frames, closed
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-t.notify:
+		case <-t.done:
+		case <-timer.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// HandleSSE opens a session whose outbound frames are streamed as
+// Server-Sent Events. The first event, open, carries the conn_id that the
+// client passes to /send.
+func (h *Handler) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	protocol, err := requestedProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hs, ok := h.beginHandshake(w, r, "sse")
+	if !ok {
+		return
+	}
+
+	t := newSSETransport(w)
+	session := newSession(hs.clientID, t, protocol)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := t.writeEvent("open", openEvent(session)); err != nil {
+		hs.fail(err)
+		return
+	}
+	defer hs.releaseConn()
+
+	h.openSession(hs, session)
+	log := session.Logger()
+	log.Info("Client connected", "remote_addr", r.RemoteAddr, "protocol", protocol.Name())
+	defer h.closeSession(session)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go session.StartPingSender(ctx)
+
+	select {
+	case <-r.Context().Done():
+		log.Info("Event stream closed by client")
+	case <-t.done:
+	}
+	t.close()
+}
+
+// HandlePollOpen opens a long-polling session and returns its conn_id. The
+// session lives until the client stops polling for longer than the
+// activity timeout or the pooler closes it.
+func (h *Handler) HandlePollOpen(w http.ResponseWriter, r *http.Request) {
+	protocol, err := requestedProtocol(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hs, ok := h.beginHandshake(w, r, "poll")
+	if !ok {
+		return
+	}
+
+	t := newPollTransport(h.opts.Fallback.PollQueueSize)
+	session := newSession(hs.clientID, t, protocol)
+	h.openSession(hs, session)
+	log := session.Logger()
+	log.Info("Client connected", "remote_addr", r.RemoteAddr, "protocol", protocol.Name())
+
+	h.manager.IncreaseWaitGroup()
+	go func() {
+		defer h.manager.DecreaseWaitGroup()
+		defer hs.releaseConn()
+		defer h.closeSession(session)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go session.StartActivityChecker(ctx, h.opts.Fallback.pollIdleTimeout(), func() {
+			log.Info("Connection timed out")
+		})
+		<-t.done
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openEvent(session))
+}
+
+// HandlePoll returns the frames queued for a long-polling session, waiting
+// up to the poll timeout for the first one. A closed session answers 410.
+func (h *Handler) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fallbackSession(w, r)
+	if !ok {
+		return
+	}
+	t, ok := session.transport.(*pollTransport)
+	if !ok {
+		http.Error(w, "Not a long-polling session", http.StatusBadRequest)
+		return
+	}
+
+	session.UpdateActivity()
+	frames, closed := t.poll(r.Context(), h.opts.Fallback.PollTimeout)
+	session.UpdateActivity()
+	if closed {
+		http.Error(w, "Session closed", http.StatusGone)
+		return
+	}
+	if frames == nil {
+		frames = []pollFrame{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(frames)
+}
+
+// HandleSend accepts one upstream frame for an SSE or long-polling session.
+// The body is a binary frame when sent as application/octet-stream and a
+// text frame otherwise. Rejections are reported on the session's stream,
+// exactly as on /ws.
+func (h *Handler) HandleSend(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.fallbackSession(w, r)
+	if !ok {
+		return
+	}
+	session.UpdateActivity()
+
+	messageType := websocket.TextMessage
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		messageType = websocket.BinaryMessage
+	}
+
+	body := io.Reader(r.Body)
+	if limit := h.opts.Frames.MaxInboundBytes; limit > 0 {
+		body = io.LimitReader(r.Body, limit+1)
+	}
+	msg, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	if limit := h.opts.Frames.MaxInboundBytes; limit > 0 && int64(len(msg)) > limit {
+		if h.opts.Frames.OversizeAction == OversizeClose {
+			metrics.FramesRejected.Add(errFrameTooLarge.reason, 1)
+			session.Logger().Info("Closed connection after oversized frame", "limit", limit)
+			session.Close(websocket.CloseMessageTooBig, errFrameTooLarge.msg)
+		} else {
+			h.rejectFrame(session, errFrameTooLarge)
+		}
+		http.Error(w, errFrameTooLarge.msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var rejection *frameRejection
+	if err := h.opts.Frames.validate(messageType, msg); errors.As(err, &rejection) {
+		h.rejectFrame(session, rejection)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if !h.handleFrame(context.WithoutCancel(r.Context()), session, messageType, msg) {
+		http.Error(w, "Session closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fallbackSession authenticates a request against an existing SSE or
+// long-polling session named by the conn_id query parameter.
+func (h *Handler) fallbackSession(w http.ResponseWriter, r *http.Request) (*ClientSession, bool) {
+	clientID, _, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	session, ok := h.manager.GetSession(r.URL.Query().Get("conn_id"))
+	if !ok || session.ID != clientID || session.Transport() == "websocket" {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+func openEvent(session *ClientSession) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"conn_id":  session.ConnID,
+		"protocol": session.Protocol().Name(),
+	})
+	return data
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// OversizeClose closes the connection with 1009 on an oversized frame.
+	OversizeClose = "close"
+	// OversizeError discards the frame and replies with an error frame.
+	OversizeError = "error"
+)
+
+// FrameConfig bounds and validates frames on the read and write paths. A
+// zero size disables that limit.
+type FrameConfig struct {
+	MaxInboundBytes  int64
+	MaxOutboundBytes int
+	OversizeAction   string
+	ValidateUTF8     bool
+	ValidateJSON     bool
+}
+
+func ParseOversizeAction(s string) (string, error) {
+	switch s {
+	case OversizeClose, OversizeError:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown oversize action %q", s)
+}
+
+// frameRejection describes why an inbound frame was refused. Code is sent
+// to the client, reason is the metrics key.
+type frameRejection struct {
+	code   string
+	reason string
+	msg    string
+}
+
+func (r *frameRejection) Error() string { return r.msg }
+
+var (
+	errFrameTooLarge = &frameRejection{ErrorCodeMessageTooLarge, "inbound_too_large", "Message exceeds the maximum size"}
+	errInvalidUTF8   = &frameRejection{ErrorCodeInvalidFrame, "invalid_utf8", "Text frame is not valid UTF-8"}
+	errInvalidJSON   = &frameRejection{ErrorCodeInvalidFrame, "invalid_json", "Text frame is not valid JSON"}
+)
+
+// prepareConn applies the read limit for the close action, letting gorilla
+// reply with 1009 itself when a frame exceeds it.
+func (c FrameConfig) prepareConn(conn *websocket.Conn) {
+	if c.MaxInboundBytes > 0 && c.OversizeAction == OversizeClose {
+		conn.SetReadLimit(c.MaxInboundBytes)
+	}
+}
+
+// readFrame reads the next frame. With the error action an oversized frame
+// is drained without being buffered and reported as a frameRejection, as
+// are frames that fail validation; other errors end the connection.
+func (c FrameConfig) readFrame(conn *websocket.Conn) (int, []byte, error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var data []byte
+	if c.MaxInboundBytes > 0 && c.OversizeAction == OversizeError {
+		data, err = io.ReadAll(io.LimitReader(r, c.MaxInboundBytes+1))
+		if err == nil && int64(len(data)) > c.MaxInboundBytes {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return 0, nil, err
+			}
+			return messageType, nil, errFrameTooLarge
+		}
+	} else {
+		data, err = io.ReadAll(r)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := c.validate(messageType, data); err != nil {
+		return messageType, nil, err
+	}
+	return messageType, data, nil
+}
+
+// validate applies the UTF-8 and JSON checks to a text frame.
+func (c FrameConfig) validate(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return nil
+	}
+	if c.ValidateUTF8 && !utf8.Valid(data) {
+		return errInvalidUTF8
+	}
+	if c.ValidateJSON && !json.Valid(data) {
+		return errInvalidJSON
+	}
+	return nil
+}
+
+// isReadLimit reports whether err is gorilla's read limit error, which
+// means the frame was oversized and a 1009 close has already been sent.
+func isReadLimit(err error) bool {
+	return errors.Is(err, websocket.ErrReadLimit)
+}
+
+// ReconnectFrame tells a client that the pooler is going away and how long
+// it should wait before reconnecting, so that clients of a draining pooler
+// spread their reconnects across the remaining instances.
+type ReconnectFrame struct {
+	Type             string `json:"type"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+// ErrorFrame reports a pooler-side rejection of a client frame.
+type ErrorFrame struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ErrorCodeRateLimited     = "rate_limited"
+	ErrorCodeMessageTooLarge = "message_too_large"
+	ErrorCodeInvalidFrame    = "invalid_frame"
+)
+
+func newErrorFrame(code, message string) ErrorFrame {
+	return ErrorFrame{Type: "error", Code: code, Message: message}
+}
@@ -2,44 +2,99 @@ package websocket
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/wailbentafat/ws-hub/admission"
 	"github.com/wailbentafat/ws-hub/auth"
 	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/logging"
+	"github.com/wailbentafat/ws-hub/metrics"
+	"github.com/wailbentafat/ws-hub/ratelimit"
+	"github.com/wailbentafat/ws-hub/tracing"
 )
 
 const (
 	BackendRequestsChannel  = "backend-requests"
 	BackendResponsesChannel = "backend-responses"
-	PresenceEventsChannel = "presence-events"
+	PresenceEventsChannel   = "presence-events"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// Options configures a Handler.
+type Options struct {
+	// PoolerID is stamped on every message this pooler publishes.
+	PoolerID string
+	// RateLimit bounds the inbound frame rate of each connection.
+	RateLimit ratelimit.Config
+	// UserLimiter, when set, additionally enforces a cluster-wide per-user
+	// message rate. Its Run must be running for the limit to hold across
+	// poolers.
+	UserLimiter *ratelimit.UserLimiter
+	// Admission caps handshakes and connections. Unlimited when nil.
+	Admission *admission.Controller
+	// Frames bounds and validates inbound and outbound frames.
+	Frames FrameConfig
+	// Compression configures permessage-deflate on outbound frames.
+	Compression CompressionConfig
+	// Fallback configures the SSE and long-polling transports.
+	Fallback FallbackConfig
+	// Signals configures ephemeral signals such as typing indicators.
+	Signals SignalConfig
+	// Presence configures idle reporting.
+	Presence PresenceConfig
+	// Routing picks the request channel of each inbound frame. Frames go
+	// to BackendRequestsChannel when it is unset.
+	Routing RoutingConfig
 }
 
 type Handler struct {
-	manager *ClientManager
-	broker  broker.MessageBroker
+	manager    *ClientManager
+	broker     broker.MessageBroker
+	opts       Options
+	upgrader   websocket.Upgrader
+	subscribed atomic.Bool
 }
 
-func NewHandler(manager *ClientManager, broker broker.MessageBroker) *Handler {
+func NewHandler(manager *ClientManager, broker broker.MessageBroker, opts Options) *Handler {
+	if opts.Admission == nil {
+		opts.Admission = admission.NewController(admission.Config{})
+	}
+	if opts.Signals.TTL <= 0 {
+		opts.Signals.TTL = defaultSignalTTL
+	}
+	if len(opts.Routing.Routes) == 0 && opts.Routing.Default == "" {
+		opts.Routing.Default = BackendRequestsChannel
+	}
 	return &Handler{
 		manager: manager,
 		broker:  broker,
+		opts:    opts,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       func(r *http.Request) bool { return true },
+			Subprotocols:      subprotocolNames(),
+			EnableCompression: opts.Compression.Enabled,
+		},
 	}
 }
 
-func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+// authenticate verifies the token of a request and returns the client ID
+// it names and its claims.
+func authenticate(r *http.Request) (string, map[string]any, error) {
 	tokenString := r.URL.Query().Get("token")
 	if tokenString == "" {
-		http.Error(w, "Token not provided", http.StatusUnauthorized)
-		return
+		return "", nil, errors.New("Token not provided")
 	}
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -48,101 +103,349 @@ func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return auth.JwtSecretKey, nil
 	})
 	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
+		return "", nil, errors.New("Invalid token")
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-		return
+		return "", nil, errors.New("Invalid token claims")
 	}
 	clientID, ok := claims["sub"].(string)
 	if !ok || clientID == "" {
-		http.Error(w, "Invalid token subject", http.StatusUnauthorized)
-		return
+		return "", nil, errors.New("Invalid token subject")
 	}
-	log.Printf("Authentication successful for clientID: %s", clientID)
+	return clientID, claims, nil
+}
+
+// rejectAdmission answers an over-limit handshake with 503 and Retry-After.
+func (h *Handler) rejectAdmission(w http.ResponseWriter, err error) {
+	retryAfter := max(int(h.opts.Admission.RetryAfter().Seconds()), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+// handshake is an authenticated and admitted client that has not opened a
+// session yet. Every transport goes through the same checks.
+type handshake struct {
+	clientID         string
+	claims           map[string]any
+	clientIP         string
+	ctx              context.Context
+	span             trace.Span
+	releaseHandshake func()
+	releaseConn      func()
+}
+
+// beginHandshake takes a handshake slot, authenticates the client and
+// admits the connection. When it returns false a response has already been
+// written; otherwise the caller must call releaseConn once the session ends.
+func (h *Handler) beginHandshake(w http.ResponseWriter, r *http.Request, transport string) (*handshake, bool) {
+	releaseHandshake, err := h.opts.Admission.AcquireHandshake()
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		logger().Warn("Handshake rejected", "remote_addr", r.RemoteAddr, "error", err)
+		h.rejectAdmission(w, err)
+		return nil, false
+	}
+
+	handshakeCtx, handshakeSpan := tracing.Tracer().Start(r.Context(), "websocket.handshake",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("wshub.transport", transport)),
+	)
+
+	clientID, claims, err := authenticate(r)
+	if err != nil {
+		handshakeSpan.SetStatus(codes.Error, err.Error())
+		handshakeSpan.End()
+		releaseHandshake()
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	handshakeSpan.SetAttributes(attribute.String("wshub.client_id", clientID))
+	logger().Debug("Authentication successful", "client_id", clientID, "remote_addr", r.RemoteAddr)
+
+	clientIP := h.opts.Admission.ClientIP(r)
+	releaseConn, err := h.opts.Admission.Admit(clientID, clientIP)
+	if err != nil {
+		handshakeSpan.SetStatus(codes.Error, err.Error())
+		handshakeSpan.End()
+		releaseHandshake()
+		logger().Warn("Connection rejected", "client_id", clientID, "client_ip", clientIP, "error", err)
+		h.rejectAdmission(w, err)
+		return nil, false
+	}
+
+	return &handshake{
+		clientID:         clientID,
+		claims:           claims,
+		clientIP:         clientIP,
+		ctx:              handshakeCtx,
+		span:             handshakeSpan,
+		releaseHandshake: releaseHandshake,
+		releaseConn:      releaseConn,
+	}, true
+}
+
+// fail ends a handshake that did not open a session.
+func (hs *handshake) fail(err error) {
+	hs.span.RecordError(err)
+	hs.span.SetStatus(codes.Error, err.Error())
+	hs.span.End()
+	hs.releaseHandshake()
+	hs.releaseConn()
+}
+
+func (h *Handler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	hs, ok := h.beginHandshake(w, r, "websocket")
+	if !ok {
 		return
 	}
 
-	session := NewClientSession(clientID, conn)
-	h.manager.AddClient(clientID, session)
+	if err := checkSubprotocols(r); err != nil {
+		hs.fail(err)
+		logger().Warn("Handshake rejected", "client_id", hs.clientID, "offered", websocket.Subprotocols(r))
+		w.Header().Set("Sec-WebSocket-Protocol", strings.Join(subprotocolNames(), ", "))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		hs.fail(err)
+		logger().Warn("WebSocket upgrade failed", "client_id", hs.clientID, "error", err)
+		return
+	}
+	defer hs.releaseConn()
 
-	go func() {
-		connectMsg := broker.Message{
-			Type:     "user_connected",
-			ClientID: clientID,
-		}
-		if err := h.broker.Publish(context.Background(), PresenceEventsChannel, connectMsg); err != nil {
-			log.Printf("Failed to publish connect event for client %s: %v", clientID, err)
-		} else {
-			log.Printf("Published 'user_connected' event for %s", clientID)
+	session := NewClientSession(hs.clientID, conn)
+	log := session.Logger()
+	compressed := h.opts.Compression.Enabled && compressionOffered(r) && compressionRequested(r)
+	if compressed {
+		if err := conn.SetCompressionLevel(h.opts.Compression.Level); err != nil {
+			log.Warn("Invalid compression level, using default", "level", h.opts.Compression.Level, "error", err)
 		}
-	}()
+	}
+	session.configureCompression(h.opts.Compression, compressed, metrics.ConnFromContext(r.Context()))
+	h.openSession(hs, session)
+	log.Info("Client connected", "remote_addr", r.RemoteAddr, "protocol", session.Protocol().Name(), "compression", compressed)
+	defer h.closeSession(session)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	h.opts.Frames.prepareConn(conn)
 	conn.SetPongHandler(func(string) error { session.UpdateActivity(); return nil })
 	go session.StartPingSender(ctx)
-	go session.StartActivityChecker(ctx, func() {
-		log.Printf("Connection timeout for client %s", clientID)
-		h.manager.RemoveClient(clientID)
+	go session.StartActivityChecker(ctx, activityTimeout, func() {
+		log.Info("Connection timed out")
+		h.manager.RemoveSession(session)
 		cancel()
 	})
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		messageType, msg, err := h.opts.Frames.readFrame(conn)
+		var rejection *frameRejection
+		if errors.As(err, &rejection) {
+			session.UpdateActivity()
+			h.rejectFrame(session, rejection)
+			continue
+		}
 		if err != nil {
-			log.Printf("Read error from client %s: %v", clientID, err)
-			break 
+			if isReadLimit(err) {
+				metrics.FramesRejected.Add(errFrameTooLarge.reason, 1)
+				log.Info("Closed connection after oversized frame", "limit", h.opts.Frames.MaxInboundBytes)
+			} else {
+				log.Info("Read error", "error", err)
+			}
+			break
 		}
 
 		session.UpdateActivity()
+		if !h.handleFrame(ctx, session, messageType, msg) {
+			break
+		}
+	}
+}
 
-		h.manager.IncreaseWaitGroup()
-		go func(messageData []byte) {
-			defer h.manager.DecreaseWaitGroup()
+// openSession completes the handshake, registers the session and announces
+// it on the presence channel.
+func (h *Handler) openSession(hs *handshake, session *ClientSession) {
+	hs.span.SetAttributes(attribute.String("wshub.conn_id", session.ConnID))
+	hs.span.End()
+	hs.releaseHandshake()
 
-			ctxTimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
-			defer cancel()
+	session.RemoteAddr = hs.clientIP
+	session.claims = hs.claims
+	session.limiter = ratelimit.NewConnLimiter(h.opts.RateLimit)
+	session.signals = newSignalState(h.opts.Signals)
+	h.watchIdle(session)
+	session.handshake = trace.LinkFromContext(hs.ctx)
+	// The session counts as pending work until closeSession, so that
+	// shutdown waits for its disconnect event and never starts waiting
+	// while a closing session can still add work.
+	h.manager.IncreaseWaitGroup()
+	h.manager.AddSession(session)
 
-			if err := h.broker.Publish(ctxTimeout, BackendRequestsChannel, broker.Message{
-				ClientID: clientID,
-				Data:     string(messageData),
-			}); err != nil {
-				log.Printf("Failed to publish message for client %s: %v", clientID, err)
-			}
-		}(msg)
-	}
+	log := session.Logger()
+	h.manager.IncreaseWaitGroup()
+	go func() {
+		defer h.manager.DecreaseWaitGroup()
+		connectMsg := broker.Message{
+			Type:     "user_connected",
+			ClientID: session.ID,
+			ConnID:   session.ConnID,
+			PoolerID: h.opts.PoolerID,
+		}
+		if err := h.broker.Publish(context.WithoutCancel(hs.ctx), PresenceEventsChannel, connectMsg); err != nil {
+			log.Error("Failed to publish connect event", "error", err)
+		} else {
+			log.Debug("Published 'user_connected' event")
+		}
+	}()
+}
 
-	
-	log.Printf("Cleaning up connection for client %s", clientID)
+// closeSession unregisters the session and announces the disconnect.
+func (h *Handler) closeSession(session *ClientSession) {
+	defer h.manager.DecreaseWaitGroup()
+	log := session.Logger()
+	log.Info("Cleaning up connection")
+	h.clearSignals(session)
+	h.stopIdle(session)
 
+	h.manager.IncreaseWaitGroup()
 	go func() {
+		defer h.manager.DecreaseWaitGroup()
 		disconnectMsg := broker.Message{
 			Type:     "user_disconnected",
-			ClientID: clientID,
+			ClientID: session.ID,
+			ConnID:   session.ConnID,
+			PoolerID: h.opts.PoolerID,
 		}
 		if err := h.broker.Publish(context.Background(), PresenceEventsChannel, disconnectMsg); err != nil {
-			log.Printf("Failed to publish disconnect event for client %s: %v", clientID, err)
+			log.Error("Failed to publish disconnect event", "error", err)
 		} else {
-			log.Printf("Published 'user_disconnected' event for %s", clientID)
+			log.Debug("Published 'user_disconnected' event")
 		}
 	}()
 
-	h.manager.RemoveClient(clientID)
+	h.manager.RemoveSession(session)
+}
+
+// rejectFrame counts a refused inbound frame and tells the client why.
+func (h *Handler) rejectFrame(session *ClientSession, rejection *frameRejection) {
+	metrics.FramesRejected.Add(rejection.reason, 1)
+	session.Logger().Debug("Inbound frame rejected", "reason", rejection.reason)
+	if err := session.SafeWriteFrame(newErrorFrame(rejection.code, rejection.msg)); err != nil {
+		session.Logger().Warn("Failed to send error frame", "error", err)
+	}
+}
+
+// handleFrame rate limits, translates and forwards one inbound frame to the
+// backends. Ephemeral signals are diverted to handleSignal, which has its
+// own limit. It returns false when the session has been closed.
+func (h *Handler) handleFrame(ctx context.Context, session *ClientSession, messageType int, msg []byte) bool {
+	log := session.Logger()
+	requestID := uuid.NewString()
+	request := broker.Message{
+		ClientID:  session.ID,
+		RequestID: requestID,
+		ConnID:    session.ConnID,
+		PoolerID:  h.opts.PoolerID,
+	}
+	if err := session.Protocol().DecodeInbound(messageType, msg, &request); err != nil {
+		log.Debug("Failed to decode frame", "error", err)
+		h.rejectFrame(session, &frameRejection{ErrorCodeInvalidFrame, "invalid_protocol_frame", err.Error()})
+		return true
+	}
+	// Claims come from the token, never from the frame.
+	request.Claims = session.claims
+	h.markInput(session)
+	if h.opts.Signals.Enabled {
+		if sig, ok := decodeSignal(request); ok {
+			h.handleSignal(session, sig)
+			return true
+		}
+	}
+
+	if !h.allowFrame(session, len(msg)) {
+		if h.opts.RateLimit.Action == ratelimit.ActionClose {
+			session.Close(websocket.ClosePolicyViolation, "Rate limit exceeded")
+			return false
+		}
+		return true
+	}
+
+	channel, service, ok := h.opts.Routing.route(request)
+	if !ok {
+		message := "No backend serves this request"
+		if service != "" {
+			message = fmt.Sprintf("Unknown service %.64q", service)
+		}
+		h.rejectFrame(session, &frameRejection{ErrorCodeUnknownService, "unknown_service", message})
+		return true
+	}
+
+	// Each frame starts its own trace, linked back to the handshake, so
+	// that a long-lived connection does not become one endless trace.
+	frameCtx, frameSpan := tracing.Tracer().Start(ctx, "websocket.inbound_frame",
+		trace.WithNewRoot(),
+		trace.WithLinks(session.handshake),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("wshub.client_id", session.ID),
+			attribute.String("wshub.request_id", requestID),
+			attribute.Int("wshub.frame_size", len(msg)),
+			attribute.Int("wshub.opcode", messageType),
+			attribute.String("wshub.protocol", session.Protocol().Name()),
+			attribute.String("wshub.transport", session.Transport()),
+			attribute.String("wshub.channel", channel),
+		),
+	)
+
+	h.manager.IncreaseWaitGroup()
+	go func() {
+		defer h.manager.DecreaseWaitGroup()
+		defer frameSpan.End()
+
+		ctxTimeout, cancel := context.WithTimeout(frameCtx, 10*time.Second)
+		defer cancel()
+
+		if err := h.broker.Publish(ctxTimeout, channel, request); err != nil {
+			frameSpan.SetStatus(codes.Error, "publish failed")
+			log.Error("Failed to publish message", "request_id", requestID, "error", err)
+			return
+		}
+		log.Debug("Forwarded frame to backend", "request_id", requestID, "channel", channel, "opcode", request.Opcode, logging.Payload(msg))
+	}()
+	return true
+}
+
+// allowFrame applies the connection and user rate limits to an inbound frame
+// and, for the throttle action, tells the client that it was dropped.
+func (h *Handler) allowFrame(session *ClientSession, size int) bool {
+	allowed := session.limiter.Allow(size)
+	if allowed && h.opts.UserLimiter != nil {
+		allowed = h.opts.UserLimiter.Allow(session.ID)
+	}
+	if allowed {
+		return true
+	}
+
+	action := h.opts.RateLimit.Action
+	metrics.FramesRejected.Add("rate_limited", 1)
+	session.Logger().Debug("Inbound frame rate limited", "action", action, "size", size)
+	if action == ratelimit.ActionThrottle {
+		if err := session.SafeWriteFrame(newErrorFrame(ErrorCodeRateLimited, "Rate limit exceeded, message dropped")); err != nil {
+			session.Logger().Warn("Failed to send throttle frame", "error", err)
+		}
+	}
+	return false
 }
 
 func (h *Handler) ListenForResponses(ctx context.Context) {
 	messageChan, err := h.broker.Subscribe(ctx, BackendResponsesChannel)
 	if err != nil {
-		log.Fatalf("Failed to subscribe to %s: %v", BackendResponsesChannel, err)
+		logging.Fatal("Failed to subscribe", "channel", BackendResponsesChannel, "error", err)
 	}
+	h.subscribed.Store(true)
+	defer h.subscribed.Store(false)
 
 	for {
 		select {
@@ -150,19 +453,71 @@ func (h *Handler) ListenForResponses(ctx context.Context) {
 			return
 		case message, ok := <-messageChan:
 			if !ok {
-				log.Println("Backend response channel closed")
+				logger().Error("Backend response channel closed")
 				return
 			}
 
-			clientID := message.ClientID
-
-			if session, ok := h.manager.GetClient(clientID); ok {
-				if err := session.SafeWriteJSON(message.Data); err != nil {
-					log.Printf("Failed to send message to client %s: %v", clientID, err)
-					session.Close(websocket.CloseInternalServerErr, "Failed to send message")
-					h.manager.RemoveClient(clientID)
-				}
+			for _, session := range h.recipients(message) {
+				h.deliver(ctx, session, message)
 			}
 		}
 	}
 }
+
+// recipients resolves the sessions a backend message is addressed to. A
+// broadcast goes to every session on this pooler. A message carrying a
+// ConnID is a reply to one connection; otherwise it goes to every
+// connection the client has on this pooler.
+func (h *Handler) recipients(message broker.Message) []*ClientSession {
+	if message.Broadcast {
+		return h.manager.Sessions()
+	}
+	if message.ConnID != "" {
+		if session, ok := h.manager.GetSession(message.ConnID); ok && session.ID == message.ClientID {
+			return []*ClientSession{session}
+		}
+		return nil
+	}
+	return h.manager.GetClientSessions(message.ClientID)
+}
+
+func (h *Handler) deliver(ctx context.Context, session *ClientSession, message broker.Message) {
+	_, span := tracing.Tracer().Start(tracing.Extract(ctx, message.Trace), "websocket.outbound_write",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("wshub.client_id", session.ID)),
+	)
+	defer span.End()
+
+	messageType, payload, err := session.Protocol().EncodeOutbound(message)
+	if err != nil {
+		span.SetStatus(codes.Error, "encode failed")
+		session.Logger().Error("Failed to encode message", "request_id", message.RequestID, "error", err)
+		return
+	}
+	if limit := h.opts.Frames.MaxOutboundBytes; limit > 0 && len(payload) > limit {
+		span.SetStatus(codes.Error, "message too large")
+		metrics.FramesRejected.Add("outbound_too_large", 1)
+		session.Logger().Warn("Dropped oversized outbound message", "request_id", message.RequestID, "size", len(payload), "limit", limit)
+		if err := session.SafeWriteFrame(newErrorFrame(ErrorCodeMessageTooLarge, "Response exceeds the maximum size")); err != nil {
+			session.Logger().Warn("Failed to send error frame", "error", err)
+		}
+		return
+	}
+
+	if err := session.SafeWrite(messageType, payload); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "write failed")
+		session.Logger().Error("Failed to send message", "request_id", message.RequestID, "error", err)
+		session.Close(websocket.CloseInternalServerErr, "Failed to send message")
+		h.manager.RemoveSession(session)
+	}
+}
+
+// CheckSubscription fails once ListenForResponses is no longer consuming
+// the backend responses channel.
+func (h *Handler) CheckSubscription(ctx context.Context) error {
+	if !h.subscribed.Load() {
+		return errors.New("backend responses subscription is not active")
+	}
+	return nil
+}
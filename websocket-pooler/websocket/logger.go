@@ -1,9 +1,11 @@
 package websocket
 
 import (
-	stdlog "log" // Import with a different name
+	"log/slog"
 )
 
-// This file provides a package-level logger for the websocket package
-// It can be extended to use a more sophisticated logging system if needed
-var log = stdlog.New(stdlog.Writer(), "[websocket] ", stdlog.LstdFlags)
+// logger returns the package-level logger. It is resolved on every call so
+// that it follows the default handler installed by logging.Setup.
+func logger() *slog.Logger {
+	return slog.Default().With("component", "websocket")
+}
@@ -1,35 +1,94 @@
 package websocket
 
 import (
+	"context"
+	"math/rand/v2"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// ClientManager tracks the open sessions of this pooler. A client may hold
+// several sessions at once, one per connection.
 type ClientManager struct {
-	clients sync.Map
-	wg      sync.WaitGroup
+	mu       sync.RWMutex
+	sessions map[string]*ClientSession            // by ConnID
+	byClient map[string]map[string]*ClientSession // by client ID, then ConnID
+	wg       sync.WaitGroup
 }
 
 func NewClientManager() *ClientManager {
 	return &ClientManager{
-		clients: sync.Map{},
+		sessions: make(map[string]*ClientSession),
+		byClient: make(map[string]map[string]*ClientSession),
 	}
 }
 
-func (m *ClientManager) AddClient(clientID string, session *ClientSession) {
-	m.clients.Store(clientID, session)
+func (m *ClientManager) AddSession(session *ClientSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ConnID] = session
+	conns, ok := m.byClient[session.ID]
+	if !ok {
+		conns = make(map[string]*ClientSession)
+		m.byClient[session.ID] = conns
+	}
+	conns[session.ConnID] = session
 }
 
-func (m *ClientManager) RemoveClient(clientID string) {
-	m.clients.Delete(clientID)
+func (m *ClientManager) RemoveSession(session *ClientSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, session.ConnID)
+	if conns, ok := m.byClient[session.ID]; ok {
+		delete(conns, session.ConnID)
+		if len(conns) == 0 {
+			delete(m.byClient, session.ID)
+		}
+	}
+}
+
+// GetSession returns the session for a single connection.
+func (m *ClientManager) GetSession(connID string) (*ClientSession, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[connID]
+	return session, ok
 }
 
-func (m *ClientManager) GetClient(clientID string) (*ClientSession, bool) {
-	if client, ok := m.clients.Load(clientID); ok {
-		return client.(*ClientSession), true
+// GetClientSessions returns every session the client has on this pooler.
+func (m *ClientManager) GetClientSessions(clientID string) []*ClientSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	conns := m.byClient[clientID]
+	sessions := make([]*ClientSession, 0, len(conns))
+	for _, session := range conns {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Sessions returns a snapshot of every open session.
+func (m *ClientManager) Sessions() []*ClientSession {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]*ClientSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
 	}
-	return nil, false
+	return sessions
+}
+
+func (m *ClientManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
 }
 
 func (m *ClientManager) IncreaseWaitGroup() {
@@ -45,14 +104,70 @@ func (m *ClientManager) WaitForCompletion() {
 }
 
 func (m *ClientManager) CloseAllConnections(reason string) {
-	m.clients.Range(func(key, value interface{}) bool {
-		clientID := key.(string)
-		session := value.(*ClientSession)
-
-		log.Printf("Closing connection for client %s: %s", clientID, reason)
+	for _, session := range m.Sessions() {
+		session.Logger().Info("Closing connection", "reason", reason)
 		session.Close(websocket.CloseGoingAway, reason)
-		m.RemoveClient(clientID)
+		m.RemoveSession(session)
+	}
+}
+
+// Drain sends every session a reconnect frame with a randomized delay hint
+// and then closes the sessions one by one, spread evenly over window. The
+// frames are sent concurrently, so a stalled client delays the drain by one
+// write timeout at most rather than holding up the sessions behind it. If
+// ctx ends before the window has elapsed, the remaining sessions are closed
+// at once.
+func (m *ClientManager) Drain(ctx context.Context, window, maxReconnectDelay time.Duration) {
+	sessions := m.Sessions()
+	if len(sessions) == 0 {
+		return
+	}
+
+	logger().Info("Draining sessions", "sessions", len(sessions), "window", window)
 
-		return true
-	})
+	var sent sync.WaitGroup
+	for _, session := range sessions {
+		var delay time.Duration
+		if maxReconnectDelay > 0 {
+			delay = rand.N(maxReconnectDelay)
+		}
+		frame := ReconnectFrame{Type: "reconnect", ReconnectAfterMs: delay.Milliseconds()}
+		sent.Add(1)
+		go func() {
+			defer sent.Done()
+			if err := session.SafeWriteFrame(frame); err != nil {
+				session.Logger().Warn("Failed to send reconnect frame", "error", err)
+			}
+		}()
+	}
+	allSent := make(chan struct{})
+	go func() {
+		sent.Wait()
+		close(allSent)
+	}()
+	select {
+	case <-allSent:
+	case <-ctx.Done():
+	}
+
+	interval := window / time.Duration(len(sessions))
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for i, session := range sessions {
+		select {
+		case <-ctx.Done():
+			logger().Warn("Drain interrupted, closing remaining sessions", "sessions", len(sessions)-i)
+			for _, rest := range sessions[i:] {
+				rest.Close(websocket.CloseGoingAway, "Server shutting down")
+				m.RemoveSession(rest)
+			}
+			return
+		case <-timer.C:
+		}
+
+		session.Close(websocket.CloseGoingAway, "Server draining")
+		m.RemoveSession(session)
+		timer.Reset(interval)
+	}
 }
@@ -0,0 +1,52 @@
+package websocket
+
+import "sync"
+
+// maxOutboxEvents bounds the events a session may have waiting for the
+// broker. Events beyond it are dropped.
+const maxOutboxEvents = 64
+
+// outbox publishes the events of one session in order on a goroutine of
+// its own, so that the read loop and timer callbacks never wait for the
+// broker. The zero value is ready to use.
+type outbox struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// push queues publish behind the events already queued. It reports false
+// when the outbox is full.
+func (o *outbox) push(manager *ClientManager, publish func()) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.queue) >= maxOutboxEvents {
+		return false
+	}
+	o.queue = append(o.queue, publish)
+	if !o.running {
+		o.running = true
+		manager.IncreaseWaitGroup()
+		go o.run(manager)
+	}
+	return true
+}
+
+// run publishes queued events until the outbox is empty.
+func (o *outbox) run(manager *ClientManager) {
+	defer manager.DecreaseWaitGroup()
+	for {
+		o.mu.Lock()
+		if len(o.queue) == 0 {
+			o.running = false
+			o.mu.Unlock()
+			return
+		}
+		publish := o.queue[0]
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+
+		publish()
+	}
+}
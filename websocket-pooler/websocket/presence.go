@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wailbentafat/ws-hub/broker"
+)
+
+// PresenceConfig configures the presence events a session reports beyond
+// connect and disconnect.
+type PresenceConfig struct {
+	// AwayAfter is how long a connection may go without an inbound frame
+	// before the pooler reports it idle. Pings and polls do not count as
+	// input. Zero disables idle reporting.
+	AwayAfter time.Duration
+}
+
+// idleState tracks whether a session has gone idle.
+type idleState struct {
+	mu        sync.Mutex
+	lastInput atomic.Int64 // UnixNano timestamp
+	timer     *time.Timer
+	idle      bool
+	closed    bool
+}
+
+// watchIdle starts reporting the session idle once it goes AwayAfter
+// without input.
+func (h *Handler) watchIdle(session *ClientSession) {
+	awayAfter := h.opts.Presence.AwayAfter
+	if awayAfter <= 0 {
+		return
+	}
+	st := &idleState{}
+	st.lastInput.Store(time.Now().UnixNano())
+	session.idle = st
+	st.timer = time.AfterFunc(awayAfter, func() { h.checkIdle(session) })
+}
+
+// markInput records an inbound frame and reports an idle session active
+// again.
+func (h *Handler) markInput(session *ClientSession) {
+	st := session.idle
+	if st == nil {
+		return
+	}
+	st.lastInput.Store(time.Now().UnixNano())
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.idle || st.closed {
+		return
+	}
+	st.idle = false
+	st.timer.Reset(h.opts.Presence.AwayAfter)
+	h.publishPresence(session, "user_active")
+}
+
+// checkIdle runs when the idle timer fires. Input that arrived since the
+// timer was armed pushes the deadline back instead.
+func (h *Handler) checkIdle(session *ClientSession) {
+	st := session.idle
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.idle || st.closed {
+		return
+	}
+	awayAfter := h.opts.Presence.AwayAfter
+	if quiet := time.Since(time.Unix(0, st.lastInput.Load())); quiet < awayAfter {
+		st.timer.Reset(awayAfter - quiet)
+		return
+	}
+	st.idle = true
+	h.publishPresence(session, "user_idle")
+}
+
+// stopIdle stops idle reporting for a closing session. The disconnect
+// event supersedes any idle state.
+func (h *Handler) stopIdle(session *ClientSession) {
+	st := session.idle
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	st.timer.Stop()
+}
+
+// publishPresence announces an idle or active transition through the
+// session's outbox, so that the read loop does not wait for the broker. It
+// is called with the session's idle lock held, which keeps transitions in
+// order.
+func (h *Handler) publishPresence(session *ClientSession, eventType string) {
+	message := broker.Message{
+		Type:     eventType,
+		ClientID: session.ID,
+		ConnID:   session.ConnID,
+		PoolerID: h.opts.PoolerID,
+	}
+
+	queued := session.events.push(h.manager, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+		defer cancel()
+		if err := h.broker.Publish(ctx, PresenceEventsChannel, message); err != nil {
+			session.Logger().Warn("Failed to publish presence event", "type", eventType, "error", err)
+			return
+		}
+		session.Logger().Debug("Published presence event", "type", eventType)
+	})
+	if !queued {
+		session.Logger().Warn("Dropped presence event, too many events waiting for the broker", "type", eventType)
+	}
+}
@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/wailbentafat/ws-hub/broker"
+)
+
+// Subprotocols advertised in Sec-WebSocket-Protocol.
+const (
+	ProtocolV1JSON    = "wshub.v1.json"
+	ProtocolV2Msgpack = "wshub.v2.msgpack"
+)
+
+// Protocol translates between the frames of one client protocol version and
+// broker messages. Backends only ever see broker messages, so the client
+// format can change without touching them, and old clients keep working
+// while new versions are rolled out.
+type Protocol interface {
+	Name() string
+	// DecodeInbound fills the Type, Data, Opcode and Binary fields of
+	// request from a client frame.
+	DecodeInbound(messageType int, frame []byte, request *broker.Message) error
+	// EncodeOutbound turns a backend message into a client frame.
+	EncodeOutbound(message broker.Message) (int, []byte, error)
+	// EncodeFrame encodes a frame generated by the pooler itself, such as
+	// an ErrorFrame or ReconnectFrame.
+	EncodeFrame(v any) (int, []byte, error)
+}
+
+var (
+	protocolV1 Protocol = jsonProtocol{}
+	protocolV2 Protocol = msgpackProtocol{}
+)
+
+// protocols lists the supported subprotocols in order of server preference.
+var protocols = []Protocol{protocolV2, protocolV1}
+
+func subprotocolNames() []string {
+	names := make([]string, len(protocols))
+	for i, p := range protocols {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+func protocolByName(name string) (Protocol, bool) {
+	for _, p := range protocols {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+var errUnsupportedProtocol = errors.New("Unsupported subprotocol")
+
+// checkSubprotocols rejects handshakes that only offer subprotocols this
+// pooler does not speak. Offering none selects v1, which is the format
+// clients used before subprotocols were negotiated.
+func checkSubprotocols(r *http.Request) error {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return nil
+	}
+	for _, name := range offered {
+		if _, ok := protocolByName(name); ok {
+			return nil
+		}
+	}
+	return errUnsupportedProtocol
+}
+
+// negotiatedProtocol returns the protocol the upgrader selected.
+func negotiatedProtocol(conn *websocket.Conn) Protocol {
+	if p, ok := protocolByName(conn.Subprotocol()); ok {
+		return p
+	}
+	return protocolV1
+}
+
+// jsonProtocol is v1: text frames carry an opaque payload that is forwarded
+// as a string, binary frames are forwarded untouched.
+type jsonProtocol struct{}
+
+func (jsonProtocol) Name() string { return ProtocolV1JSON }
+
+func (jsonProtocol) DecodeInbound(messageType int, frame []byte, request *broker.Message) error {
+	if messageType == websocket.BinaryMessage {
+		request.Opcode = broker.OpcodeBinary
+		request.Binary = frame
+		return nil
+	}
+	request.Opcode = broker.OpcodeText
+	request.Data = string(frame)
+	return nil
+}
+
+// EncodeOutbound writes binary messages as-is and everything else as JSON
+// text.
+func (jsonProtocol) EncodeOutbound(message broker.Message) (int, []byte, error) {
+	if message.Opcode == broker.OpcodeBinary {
+		return websocket.BinaryMessage, message.Binary, nil
+	}
+	payload, err := json.Marshal(message.Data)
+	return websocket.TextMessage, payload, err
+}
+
+func (jsonProtocol) EncodeFrame(v any) (int, []byte, error) {
+	payload, err := json.Marshal(v)
+	return websocket.TextMessage, payload, err
+}
+
+// msgpackEnvelope is the v2 frame, sent as a binary WebSocket message in
+// both directions.
+type msgpackEnvelope struct {
+	Type      string `msgpack:"type,omitempty"`
+	RequestID string `msgpack:"request_id,omitempty"`
+	Data      any    `msgpack:"data,omitempty"`
+	Binary    []byte `msgpack:"binary,omitempty"`
+}
+
+// msgpackProtocol is v2: every frame is a msgpack envelope that names its
+// type, so backends get structured data instead of an opaque string.
+type msgpackProtocol struct{}
+
+func (msgpackProtocol) Name() string { return ProtocolV2Msgpack }
+
+func (msgpackProtocol) DecodeInbound(messageType int, frame []byte, request *broker.Message) error {
+	if messageType != websocket.BinaryMessage {
+		return fmt.Errorf("%s expects binary frames", ProtocolV2Msgpack)
+	}
+	var env msgpackEnvelope
+	if err := msgpack.Unmarshal(frame, &env); err != nil {
+		return fmt.Errorf("decode %s frame: %w", ProtocolV2Msgpack, err)
+	}
+	request.Type = env.Type
+	request.Data = env.Data
+	if len(env.Binary) > 0 {
+		request.Opcode = broker.OpcodeBinary
+		request.Binary = env.Binary
+	} else {
+		request.Opcode = broker.OpcodeText
+	}
+	return nil
+}
+
+func (msgpackProtocol) EncodeOutbound(message broker.Message) (int, []byte, error) {
+	env := msgpackEnvelope{
+		Type:      message.Type,
+		RequestID: message.RequestID,
+		Data:      message.Data,
+	}
+	if message.Opcode == broker.OpcodeBinary {
+		env.Binary = message.Binary
+	}
+	payload, err := msgpack.Marshal(&env)
+	return websocket.BinaryMessage, payload, err
+}
+
+// EncodeFrame reuses the JSON field names of pooler frames so that both
+// protocol versions see the same keys.
+func (msgpackProtocol) EncodeFrame(v any) (int, []byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, buf.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/wailbentafat/ws-hub/broker"
+)
+
+// ErrorCodeUnknownService answers a frame that names a service no route
+// leads to.
+const ErrorCodeUnknownService = "unknown_service"
+
+// RoutingConfig routes inbound frames to per-service request channels.
+// A frame names its service with a "service" field or with a type prefix,
+// such as "chat" for "chat.send". Frames that name no service go to
+// Default.
+type RoutingConfig struct {
+	// Routes maps service names to request channels. When empty every frame
+	// goes to Default.
+	Routes map[string]string
+	// Default receives the frames that name no service. When empty such
+	// frames are answered with unknown_service.
+	Default string
+}
+
+// ParseRoutes parses a comma-separated list of service=channel routes. A
+// service may be written as a type prefix pattern, "chat.*".
+func ParseRoutes(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service, channel, ok := strings.Cut(entry, "=")
+		service = strings.TrimSuffix(strings.TrimSpace(service), ".*")
+		channel = strings.TrimSpace(channel)
+		if !ok || service == "" || channel == "" || strings.ContainsAny(service, ".*") {
+			return nil, fmt.Errorf("invalid route %q, want service=channel", entry)
+		}
+		if _, dup := routes[service]; dup {
+			return nil, fmt.Errorf("duplicate route for service %q", service)
+		}
+		routes[service] = channel
+	}
+	return routes, nil
+}
+
+// routingFields are the fields of a v1 text frame that routing reads.
+type routingFields struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+}
+
+// route returns the request channel for a decoded frame. It returns the
+// service the frame named and false when no route leads to it.
+func (c RoutingConfig) route(request broker.Message) (channel, service string, ok bool) {
+	if len(c.Routes) == 0 {
+		return c.Default, "", c.Default != ""
+	}
+	service = frameService(request)
+	if service == "" {
+		return c.Default, "", c.Default != ""
+	}
+	channel, ok = c.Routes[service]
+	return channel, service, ok
+}
+
+// frameService finds the service a frame names: its service field, or
+// else the prefix of a dotted type. v1 binary and non-JSON frames name
+// none.
+func frameService(request broker.Message) string {
+	fields := routingFields{Type: request.Type}
+	switch data := request.Data.(type) {
+	case string:
+		if request.Type == "" {
+			json.Unmarshal([]byte(data), &fields)
+		}
+	case map[string]any:
+		fields.Service, _ = data["service"].(string)
+	}
+
+	if fields.Service != "" {
+		return fields.Service
+	}
+	if service, _, dotted := strings.Cut(fields.Type, "."); dotted {
+		return service
+	}
+	return ""
+}
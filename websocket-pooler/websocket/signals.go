@@ -0,0 +1,297 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
+
+	"github.com/wailbentafat/ws-hub/broker"
+	"github.com/wailbentafat/ws-hub/metrics"
+)
+
+// SignalEventsChannel carries ephemeral signals from poolers to the
+// backends that relay them. Signals never touch durable storage.
+const SignalEventsChannel = "ephemeral-events"
+
+// signalType is the frame type that marks a client frame as an ephemeral
+// signal rather than a backend request.
+const signalType = "ephemeral"
+
+const (
+	maxSignalKindLength = 32
+	defaultSignalTTL    = 5 * time.Second
+)
+
+// SignalConfig configures ephemeral signals such as typing indicators.
+type SignalConfig struct {
+	// Enabled makes the pooler handle ephemeral frames itself. When false
+	// they are forwarded to the backends like any other frame.
+	Enabled bool
+	// Rate and Burst bound the signals a connection may send, independent of
+	// the message rate limit. Excess signals are dropped silently.
+	Rate  float64
+	Burst int
+	// Coalesce is the minimum interval between two signals of the same kind
+	// to the same target. Signals in between replace each other and only
+	// the latest is sent.
+	Coalesce time.Duration
+	// TTL is how long a signal stays active without a refresh. When it
+	// lapses the pooler sends a clear on the client's behalf.
+	TTL time.Duration
+	// MaxDataBytes bounds the encoded data carried by a signal.
+	MaxDataBytes int
+}
+
+// Signal is an ephemeral event sent to the members of a room or to the
+// other side of a direct conversation. Exactly one of RoomID and To is set.
+type Signal struct {
+	Kind   string `json:"kind" msgpack:"kind"`
+	RoomID string `json:"room_id,omitempty" msgpack:"room_id,omitempty"`
+	To     string `json:"to,omitempty" msgpack:"to,omitempty"`
+	Data   any    `json:"data,omitempty" msgpack:"data,omitempty"`
+	// Clear ends the signal, such as a user who stopped typing.
+	Clear bool `json:"clear,omitempty" msgpack:"clear,omitempty"`
+	// TTLMs tells recipients when to drop the signal if no refresh or clear
+	// arrives. It is set by the pooler.
+	TTLMs int64 `json:"ttl_ms,omitempty" msgpack:"ttl_ms,omitempty"`
+}
+
+func (s Signal) key() string {
+	return s.Kind + "\x00" + s.RoomID + "\x00" + s.To
+}
+
+// signalFrame is the v1 client frame of a signal.
+type signalFrame struct {
+	Type string `json:"type"`
+	Signal
+}
+
+// decodeSignal recognises an ephemeral frame in a decoded request. v1
+// clients send the signal fields next to the type; v2 clients send them
+// in data.
+func decodeSignal(request broker.Message) (Signal, bool) {
+	var sig Signal
+	switch data := request.Data.(type) {
+	case string:
+		if request.Type != "" || !strings.Contains(data, `"`+signalType+`"`) {
+			return sig, false
+		}
+		var frame signalFrame
+		if err := json.Unmarshal([]byte(data), &frame); err != nil || frame.Type != signalType {
+			return sig, false
+		}
+		sig = frame.Signal
+	default:
+		if request.Type != signalType {
+			return sig, false
+		}
+		raw, err := msgpack.Marshal(data)
+		if err != nil || msgpack.Unmarshal(raw, &sig) != nil {
+			return sig, false
+		}
+	}
+	sig.TTLMs = 0
+	return sig, true
+}
+
+// validate reports what is wrong with a signal, or "" when it is valid.
+func (c SignalConfig) validate(sig Signal) string {
+	switch {
+	case sig.Kind == "" || len(sig.Kind) > maxSignalKindLength:
+		return "Signal kind is missing or too long"
+	case (sig.RoomID == "") == (sig.To == ""):
+		return "Signal needs exactly one of room_id and to"
+	}
+	if sig.Data != nil && c.MaxDataBytes > 0 {
+		if data, err := json.Marshal(sig.Data); err != nil || len(data) > c.MaxDataBytes {
+			return "Signal data is too large"
+		}
+	}
+	return ""
+}
+
+// signalState tracks the signals of one session.
+type signalState struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	active  map[string]*activeSignal
+	closed  bool
+}
+
+// activeSignal is one kind of signal to one target. pending holds the
+// latest signal held back by coalescing.
+type activeSignal struct {
+	lastSent  time.Time
+	expiresAt time.Time
+	pending   *Signal
+	flush     *time.Timer
+	expire    *time.Timer
+}
+
+func newSignalState(cfg SignalConfig) *signalState {
+	limit := rate.Inf
+	if cfg.Rate > 0 {
+		limit = rate.Limit(cfg.Rate)
+	}
+	return &signalState{
+		limiter: rate.NewLimiter(limit, max(cfg.Burst, 1)),
+		active:  make(map[string]*activeSignal),
+	}
+}
+
+// handleSignal rate limits and coalesces a signal, then publishes it.
+func (h *Handler) handleSignal(session *ClientSession, sig Signal) {
+	cfg := h.opts.Signals
+	if problem := cfg.validate(sig); problem != "" {
+		h.rejectFrame(session, &frameRejection{ErrorCodeInvalidFrame, "invalid_signal", problem})
+		return
+	}
+
+	st := session.signals
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	if !st.limiter.Allow() {
+		metrics.Signals.Add("rate_limited", 1)
+		return
+	}
+
+	key := sig.key()
+	a, ok := st.active[key]
+	if !ok {
+		if sig.Clear {
+			// Nothing to clear.
+			return
+		}
+		a = &activeSignal{}
+		st.active[key] = a
+	}
+
+	if sig.Clear {
+		a.expire.Stop()
+		delete(st.active, key)
+		if a.flush != nil {
+			a.flush.Stop()
+		}
+		h.publishSignal(session, sig)
+		return
+	}
+
+	a.expiresAt = time.Now().Add(cfg.TTL)
+	if a.expire == nil {
+		a.expire = time.AfterFunc(cfg.TTL, func() { h.expireSignal(session, key) })
+	} else {
+		a.expire.Reset(cfg.TTL)
+	}
+
+	wait := cfg.Coalesce - time.Since(a.lastSent)
+	if wait <= 0 && a.pending == nil {
+		a.lastSent = time.Now()
+		h.publishSignal(session, sig)
+		return
+	}
+	if a.pending != nil {
+		metrics.Signals.Add("coalesced", 1)
+	}
+	a.pending = &sig
+	if a.flush == nil {
+		a.flush = time.AfterFunc(max(wait, 0), func() { h.flushSignal(session, key) })
+	}
+}
+
+// flushSignal sends the latest signal held back by coalescing.
+func (h *Handler) flushSignal(session *ClientSession, key string) {
+	st := session.signals
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	a, ok := st.active[key]
+	if !ok || a.pending == nil || st.closed {
+		return
+	}
+	sig := *a.pending
+	a.pending, a.flush = nil, nil
+	a.lastSent = time.Now()
+	h.publishSignal(session, sig)
+}
+
+// expireSignal clears a signal that was not refreshed within the TTL.
+func (h *Handler) expireSignal(session *ClientSession, key string) {
+	st := session.signals
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	a, ok := st.active[key]
+	if !ok || st.closed || time.Now().Before(a.expiresAt) {
+		// Cleared, or refreshed while the timer was firing.
+		return
+	}
+	delete(st.active, key)
+	if a.flush != nil {
+		a.flush.Stop()
+	}
+	metrics.Signals.Add("expired", 1)
+	h.publishSignal(session, clearOf(key))
+}
+
+// clearSignals clears every active signal of a closing session, so that
+// recipients do not wait for the TTL.
+func (h *Handler) clearSignals(session *ClientSession) {
+	st := session.signals
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.closed = true
+	for key, a := range st.active {
+		a.expire.Stop()
+		if a.flush != nil {
+			a.flush.Stop()
+		}
+		h.publishSignal(session, clearOf(key))
+	}
+	clear(st.active)
+}
+
+// clearOf rebuilds the clear signal for a key.
+func clearOf(key string) Signal {
+	parts := strings.SplitN(key, "\x00", 3)
+	return Signal{Kind: parts[0], RoomID: parts[1], To: parts[2], Clear: true}
+}
+
+// publishSignal hands a signal to the backends through the session's
+// outbox. It is called with the session's signal lock held, which keeps a
+// signal and its clear in order without waiting for the broker.
+func (h *Handler) publishSignal(session *ClientSession, sig Signal) {
+	if !sig.Clear {
+		sig.TTLMs = h.opts.Signals.TTL.Milliseconds()
+	}
+	message := broker.Message{
+		Type:     signalType,
+		ClientID: session.ID,
+		ConnID:   session.ConnID,
+		PoolerID: h.opts.PoolerID,
+		Data:     sig,
+	}
+
+	queued := session.events.push(h.manager, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+		defer cancel()
+		if err := h.broker.Publish(ctx, SignalEventsChannel, message); err != nil {
+			metrics.Signals.Add("publish_failed", 1)
+			session.Logger().Warn("Failed to publish signal", "kind", sig.Kind, "error", err)
+			return
+		}
+		metrics.Signals.Add("published", 1)
+	})
+	if !queued {
+		metrics.Signals.Add("dropped", 1)
+		session.Logger().Warn("Dropped signal, too many events waiting for the broker", "kind", sig.Kind)
+	}
+}
@@ -0,0 +1,50 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport carries the frames of a ClientSession to the client. WebSocket
+// is the primary transport; SSE and long-polling are fallbacks for networks
+// that block the upgrade. Frame types are the WebSocket message types.
+type transport interface {
+	name() string
+	writeFrame(messageType int, payload []byte, compress bool) error
+	// queued is the number of frames buffered and not yet sent.
+	queued() int
+	writePing() error
+	writeClose(code int, text string) error
+	close() error
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (wsTransport) name() string { return "websocket" }
+
+func (t wsTransport) writeFrame(messageType int, payload []byte, compress bool) error {
+	t.conn.EnableWriteCompression(compress)
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(messageType, payload)
+}
+
+func (wsTransport) queued() int { return 0 }
+
+func (t wsTransport) writePing() error {
+	return t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+func (t wsTransport) writeClose(code int, text string) error {
+	return t.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(writeWait),
+	)
+}
+
+func (t wsTransport) close() error {
+	return t.conn.Close()
+}